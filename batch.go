@@ -0,0 +1,175 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// BatchOp is an operation performed by RunBatch. It is implemented by InsertOp,
+// UpdateOp and DeleteOp.
+type BatchOp interface {
+	// target returns the item the operation applies to and true if the ETag
+	// of this item must be checked before performing the operation.
+	target() (item *resource.Item, checkEtag bool)
+	// bulkRequest returns the bulk request performing the operation on the
+	// document with the given id and version.
+	bulkRequest(h *Handler, id string, ver int64) elastic.BulkableRequest
+}
+
+// InsertOp is a batch operation inserting Item.
+type InsertOp struct {
+	Item *resource.Item
+}
+
+func (o InsertOp) target() (*resource.Item, bool) {
+	return o.Item, false
+}
+
+func (o InsertOp) bulkRequest(h *Handler, id string, ver int64) elastic.BulkableRequest {
+	return h.insertRequest(h.itemIndex(o.Item), id, o.Item)
+}
+
+// UpdateOp is a batch operation replacing Original by Item.
+type UpdateOp struct {
+	Item     *resource.Item
+	Original *resource.Item
+}
+
+func (o UpdateOp) target() (*resource.Item, bool) {
+	return o.Original, true
+}
+
+func (o UpdateOp) bulkRequest(h *Handler, id string, ver int64) elastic.BulkableRequest {
+	req := elastic.NewBulkUpdateRequest().Index(h.itemIndex(o.Original)).Type(h.typ).Id(id).Doc(buildDoc(o.Item, h.SuggestFields)).Version(ver)
+	if r := h.routing(o.Original); r != "" {
+		req.Routing(r)
+	}
+	return req
+}
+
+// DeleteOp is a batch operation deleting Item.
+type DeleteOp struct {
+	Item *resource.Item
+}
+
+func (o DeleteOp) target() (*resource.Item, bool) {
+	return o.Item, true
+}
+
+func (o DeleteOp) bulkRequest(h *Handler, id string, ver int64) elastic.BulkableRequest {
+	req := elastic.NewBulkDeleteRequest().Index(h.itemIndex(o.Item)).Type(h.typ).Id(id).Version(ver)
+	if r := h.routing(o.Item); r != "" {
+		req.Routing(r)
+	}
+	return req
+}
+
+// RunBatch performs ops in a single bulk operation. The ETags of the items
+// updated or deleted are all checked first with a single multi get, so no
+// operation is performed if one of them does not match (resource.ErrConflict)
+// or if one of the items does not exist (resource.ErrNotFound). ES not
+// supporting transactions, the bulk operation itself can still partially fail,
+// in which case a *BulkError is returned. As with Insert, Update and Delete,
+// the ValidateDocumentFilter, AutoGenerateID and dry run settings apply.
+func (h *Handler) RunBatch(ctx context.Context, ops []BatchOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	items := make([]*resource.Item, 0, len(ops))
+	for _, op := range ops {
+		item, _ := op.target()
+		items = append(items, item)
+		if u, ok := op.(UpdateOp); ok {
+			items = append(items, u.Item)
+		}
+	}
+	if err := h.validateDocumentFilter(ctx, items); err != nil {
+		return err
+	}
+	ids := make([]string, len(ops))
+	vers := make([]int64, len(ops))
+	checks := []int{}
+	g := h.client.MultiGet()
+	fsc := elastic.NewFetchSourceContext(true).Include(etagField)
+	for i, op := range ops {
+		item, check := op.target()
+		// Only inserted items can have their id generated
+		id, err := h.itemID(item, !check)
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+		if !check {
+			continue
+		}
+		mi := elastic.NewMultiGetItem().Index(h.itemIndex(item)).Type(h.typ).Id(id).FetchSource(fsc)
+		if r := h.routing(item); r != "" {
+			mi.Routing(r)
+		}
+		g.Add(mi)
+		checks = append(checks, i)
+	}
+
+	// Check all the ETags before performing any operation
+	if len(checks) > 0 {
+		res, err := g.Do(ctx)
+		if err != nil {
+			if !translateError(&err) {
+				err = fmt.Errorf("batch etag check error (index=%s, type=%s): %v", h.index, h.typ, err)
+			}
+			return err
+		}
+		if len(res.Docs) != len(checks) {
+			return fmt.Errorf("batch etag check error (index=%s, type=%s): got %d docs for %d items", h.index, h.typ, len(res.Docs), len(checks))
+		}
+		for j, doc := range res.Docs {
+			if !doc.Found || doc.Source == nil || doc.Version == nil {
+				return resource.ErrNotFound
+			}
+			d := struct {
+				ETag string `json:"_etag"`
+			}{}
+			if err := json.Unmarshal(*doc.Source, &d); err != nil {
+				return fmt.Errorf("batch etag check unmarshaling error (index=%s, type=%s, id=%s): %v", h.index, h.typ, doc.Id, err)
+			}
+			i := checks[j]
+			if item, _ := ops[i].target(); d.ETag != item.ETag {
+				return resource.ErrConflict
+			}
+			vers[i] = *doc.Version
+		}
+	}
+
+	// Check if context is still valid
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if GetESOptions(ctx).DryRun {
+		return nil
+	}
+	reqs := make([]elastic.BulkableRequest, len(ops))
+	positions := make([]int, len(ops))
+	targets := make([]*resource.Item, len(ops))
+	for i, op := range ops {
+		reqs[i] = op.bulkRequest(h, ids[i], vers[i])
+		positions[i] = i
+		targets[i], _ = op.target()
+	}
+	res, err := h.doBulk(ctx, reqs)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("batch error: %v", err)
+		}
+		return err
+	}
+	if h.AutoGenerateID {
+		setGeneratedIDs(res, targets, positions)
+	}
+	return getBulkError(res)
+}
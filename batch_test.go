@@ -0,0 +1,128 @@
+package es
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestRunBatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testrunbatch")()
+	h := NewHandler(c, "testrunbatch", "test")
+	h.Refresh = "true"
+	ctx := context.TODO()
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+	assert.NoError(t, h.RunBatch(ctx, nil))
+
+	updated := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "name": "aa"}}
+	inserted := &resource.Item{ID: "3", ETag: "a", Payload: map[string]interface{}{"id": "3", "name": "c"}}
+
+	// A wrong ETag prevents all operations
+	err = h.RunBatch(ctx, []BatchOp{
+		InsertOp{Item: inserted},
+		UpdateOp{Item: updated, Original: items[0]},
+		DeleteOp{Item: &resource.Item{ID: "2", ETag: "x"}},
+	})
+	assert.Equal(t, resource.ErrConflict, err)
+	// So does a missing item
+	err = h.RunBatch(ctx, []BatchOp{
+		InsertOp{Item: inserted},
+		DeleteOp{Item: &resource.Item{ID: "4", ETag: "a"}},
+	})
+	assert.Equal(t, resource.ErrNotFound, err)
+	l, err := h.MultiGet(ctx, []interface{}{"1", "2", "3"})
+	if assert.NoError(t, err) && assert.Len(t, l, 2) {
+		assert.Equal(t, "a", l[0].Payload["name"])
+	}
+
+	err = h.RunBatch(ctx, []BatchOp{
+		InsertOp{Item: inserted},
+		UpdateOp{Item: updated, Original: items[0]},
+		DeleteOp{Item: items[1]},
+	})
+	assert.NoError(t, err)
+	l, err = h.MultiGet(ctx, []interface{}{"1", "2", "3"})
+	if assert.NoError(t, err) && assert.Len(t, l, 2) {
+		assert.Equal(t, "1", l[0].ID)
+		assert.Equal(t, "b", l[0].ETag)
+		assert.Equal(t, "aa", l[0].Payload["name"])
+		assert.Equal(t, "3", l[1].ID)
+	}
+}
+
+func TestRunBatchDocumentFilter(t *testing.T) {
+	h := &Handler{index: "test", typ: "test", DocumentFilter: tenantFilter, ValidateDocumentFilter: true}
+	ctx := context.WithValue(context.Background(), tenantCtxKey{}, "a")
+	own := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "tenant": "a"}}
+	other := &resource.Item{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "tenant": "b"}}
+	// Items of other tenants can't be inserted, moved to or changed
+	assert.Equal(t, resource.ErrForbidden, h.RunBatch(ctx, []BatchOp{InsertOp{Item: other}}))
+	assert.Equal(t, resource.ErrForbidden, h.RunBatch(ctx, []BatchOp{UpdateOp{Item: other, Original: own}}))
+	assert.Equal(t, resource.ErrForbidden, h.RunBatch(ctx, []BatchOp{UpdateOp{Item: own, Original: other}}))
+	assert.Equal(t, resource.ErrForbidden, h.RunBatch(ctx, []BatchOp{InsertOp{Item: own}, DeleteOp{Item: other}}))
+}
+
+func TestRunBatchDryRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testrunbatchdryrun")()
+	h := NewHandler(c, "testrunbatchdryrun", "test")
+	h.Refresh = "true"
+	h.AutoGenerateID = true
+	ctx := context.TODO()
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	updated := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "name": "aa"}}
+	inserted := &resource.Item{ETag: "a", Payload: map[string]interface{}{"name": "c"}}
+	ops := []BatchOp{
+		InsertOp{Item: inserted},
+		UpdateOp{Item: updated, Original: items[0]},
+		DeleteOp{Item: items[1]},
+	}
+	// ETags are checked but nothing is written in dry run mode
+	dctx := WithESOptions(ctx, ESRequestOptions{DryRun: true})
+	assert.Equal(t, resource.ErrConflict, h.RunBatch(dctx, []BatchOp{DeleteOp{Item: updated}}))
+	assert.NoError(t, h.RunBatch(dctx, ops))
+	n, err := c.Count("testrunbatchdryrun").Do(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), n)
+	}
+	l, err := h.MultiGet(ctx, []interface{}{"1"})
+	if assert.NoError(t, err) && assert.Len(t, l, 1) {
+		assert.Equal(t, "a", l[0].Payload["name"])
+	}
+
+	// Inserted items get the id generated by ES
+	assert.NoError(t, h.RunBatch(ctx, ops))
+	if assert.IsType(t, "", inserted.ID) {
+		assert.NotEmpty(t, inserted.ID)
+		assert.Equal(t, inserted.ID, inserted.Payload["id"])
+	}
+	n, err = c.Count("testrunbatchdryrun").Do(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), n)
+	}
+}
@@ -0,0 +1,221 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// IndexInfo holds the cat indices information of the handler's index.
+type IndexInfo struct {
+	// DocCount is the number of documents in the primary shards.
+	DocCount int
+	// StoreSize is the size of all the shards (including replicas) in bytes.
+	StoreSize int64
+	// PrimaryShards is the number of primary shards.
+	PrimaryShards int
+	// ReplicaShards is the number of replicas per primary shard.
+	ReplicaShards int
+	// Status is the status of the index (open or close).
+	Status string
+	// Health is the health of the index (green, yellow or red).
+	Health string
+}
+
+// ShardCatInfo holds the cat shards information of a single shard copy of the
+// handler's index.
+type ShardCatInfo struct {
+	// Shard is the shard number.
+	Shard int
+	// Primary is true for primary shards and false for replicas.
+	Primary bool
+	// State is the state of the shard copy (STARTED, RELOCATING, INITIALIZING
+	// or UNASSIGNED).
+	State string
+	// DocCount is the number of documents in the shard copy.
+	DocCount int
+	// StoreSize is the size of the shard copy in bytes.
+	StoreSize int64
+	// Node is the name of the node holding the shard copy if assigned.
+	Node string
+}
+
+// RecoveryInfo holds the cat recovery information of an ongoing recovery of a
+// shard copy of the handler's index.
+type RecoveryInfo struct {
+	// Shard is the shard number.
+	Shard int
+	// Stage is the recovery stage (init, index, verify_index, translog,
+	// finalize).
+	Stage string
+	// Source is the name of the node the shard is recovered from, if any.
+	Source string
+	// Target is the name of the node the shard is recovered to.
+	Target string
+	// BytesPercent is the percentage of the bytes already recovered.
+	BytesPercent float64
+}
+
+// catIndex is a row of the cat indices API response in JSON format.
+type catIndex struct {
+	Health    string `json:"health"`
+	Status    string `json:"status"`
+	Pri       string `json:"pri"`
+	Rep       string `json:"rep"`
+	DocsCount string `json:"docs.count"`
+	StoreSize string `json:"store.size"`
+}
+
+// catShard is a row of the cat shards API response in JSON format.
+type catShard struct {
+	Shard  string `json:"shard"`
+	Prirep string `json:"prirep"`
+	State  string `json:"state"`
+	Docs   string `json:"docs"`
+	Store  string `json:"store"`
+	Node   string `json:"node"`
+}
+
+// catRecovery is a row of the cat recovery API response in JSON format.
+type catRecovery struct {
+	Shard        string `json:"shard"`
+	Stage        string `json:"stage"`
+	SourceNode   string `json:"source_node"`
+	TargetNode   string `json:"target_node"`
+	BytesPercent string `json:"bytes_percent"`
+}
+
+// catAtoi parses a cat API numeric column, empty for unassigned shards.
+func catAtoi(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// cat queries the api cat API for the handler's index and decodes its JSON rows
+// into rows. Sizes are requested in bytes.
+//
+// The elastic client has no cat services for ES 5, so the cat API is queried
+// directly.
+func (h *Handler) cat(ctx context.Context, api string, rows interface{}) error {
+	params := url.Values{}
+	params.Set("format", "json")
+	params.Set("bytes", "b")
+	path := fmt.Sprintf("/_cat/%s/%s", api, url.PathEscape(h.index))
+	res, err := h.client.PerformRequest(ctx, "GET", path, params, nil)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("cat %s error (index=%s): %v", api, h.index, err)
+		}
+		return err
+	}
+	if err := json.Unmarshal(res.Body, rows); err != nil {
+		return fmt.Errorf("cat %s unmarshaling error (index=%s): %v", api, h.index, err)
+	}
+	return nil
+}
+
+// CatIndex returns the cat indices information of the handler's index. If the
+// index does not exist, resource.ErrNotFound is returned.
+func (h *Handler) CatIndex(ctx context.Context) (*IndexInfo, error) {
+	rows := []catIndex{}
+	if err := h.cat(ctx, "indices", &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("cat indices unexpected number of indices (index=%s): %d", h.index, len(rows))
+	}
+	r := rows[0]
+	info := &IndexInfo{
+		Status: r.Status,
+		Health: r.Health,
+	}
+	var err error
+	var n int64
+	if n, err = catAtoi(r.DocsCount); err != nil {
+		return nil, fmt.Errorf("cat indices invalid docs.count (index=%s): %q", h.index, r.DocsCount)
+	}
+	info.DocCount = int(n)
+	if info.StoreSize, err = catAtoi(r.StoreSize); err != nil {
+		return nil, fmt.Errorf("cat indices invalid store.size (index=%s): %q", h.index, r.StoreSize)
+	}
+	if n, err = catAtoi(r.Pri); err != nil {
+		return nil, fmt.Errorf("cat indices invalid pri (index=%s): %q", h.index, r.Pri)
+	}
+	info.PrimaryShards = int(n)
+	if n, err = catAtoi(r.Rep); err != nil {
+		return nil, fmt.Errorf("cat indices invalid rep (index=%s): %q", h.index, r.Rep)
+	}
+	info.ReplicaShards = int(n)
+	return info, nil
+}
+
+// CatShards returns the cat shards information of every shard copy (primaries
+// and replicas) of the handler's index. If the index does not exist,
+// resource.ErrNotFound is returned.
+func (h *Handler) CatShards(ctx context.Context) ([]ShardCatInfo, error) {
+	rows := []catShard{}
+	if err := h.cat(ctx, "shards", &rows); err != nil {
+		return nil, err
+	}
+	shards := make([]ShardCatInfo, 0, len(rows))
+	for _, r := range rows {
+		s := ShardCatInfo{
+			Primary: r.Prirep == "p",
+			State:   r.State,
+			Node:    r.Node,
+		}
+		n, err := catAtoi(r.Shard)
+		if err != nil {
+			return nil, fmt.Errorf("cat shards invalid shard number (index=%s): %q", h.index, r.Shard)
+		}
+		s.Shard = int(n)
+		if n, err = catAtoi(r.Docs); err != nil {
+			return nil, fmt.Errorf("cat shards invalid docs (index=%s): %q", h.index, r.Docs)
+		}
+		s.DocCount = int(n)
+		if s.StoreSize, err = catAtoi(r.Store); err != nil {
+			return nil, fmt.Errorf("cat shards invalid store (index=%s): %q", h.index, r.Store)
+		}
+		shards = append(shards, s)
+	}
+	return shards, nil
+}
+
+// RecoveryStatus returns the cat recovery information of the shard copies of
+// the handler's index being recovered (i.e.: after a node failure). An empty
+// slice is returned when no recovery is in progress. If the index does not
+// exist, resource.ErrNotFound is returned.
+func (h *Handler) RecoveryStatus(ctx context.Context) ([]RecoveryInfo, error) {
+	rows := []catRecovery{}
+	if err := h.cat(ctx, "recovery", &rows); err != nil {
+		return nil, err
+	}
+	recoveries := []RecoveryInfo{}
+	for _, r := range rows {
+		// ES 5 cat recovery has no active_only parameter, completed
+		// recoveries are thus filtered out here
+		if r.Stage == "done" {
+			continue
+		}
+		ri := RecoveryInfo{
+			Stage:  r.Stage,
+			Source: r.SourceNode,
+			Target: r.TargetNode,
+		}
+		n, err := catAtoi(r.Shard)
+		if err != nil {
+			return nil, fmt.Errorf("cat recovery invalid shard number (index=%s): %q", h.index, r.Shard)
+		}
+		ri.Shard = int(n)
+		if ri.BytesPercent, err = strconv.ParseFloat(strings.TrimSuffix(r.BytesPercent, "%"), 64); err != nil {
+			return nil, fmt.Errorf("cat recovery invalid bytes_percent (index=%s): %q", h.index, r.BytesPercent)
+		}
+		recoveries = append(recoveries, ri)
+	}
+	return recoveries, nil
+}
@@ -0,0 +1,76 @@
+package es
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestCatAtoi(t *testing.T) {
+	n, err := catAtoi("")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	n, err = catAtoi("1234")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1234), n)
+	_, err = catAtoi("1kb")
+	assert.Error(t, err)
+}
+
+func TestCat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testcat")()
+	h := NewHandler(c, "testcat", "test", WithShards(2), WithReplicas(0))
+	h.Refresh = "true"
+	ctx := context.TODO()
+
+	_, err = h.CatIndex(ctx)
+	assert.Equal(t, resource.ErrNotFound, err)
+	_, err = h.CatShards(ctx)
+	assert.Equal(t, resource.ErrNotFound, err)
+	_, err = h.RecoveryStatus(ctx)
+	assert.Equal(t, resource.ErrNotFound, err)
+
+	assert.NoError(t, h.EnsureIndex(ctx))
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	info, err := h.CatIndex(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, info.DocCount)
+		assert.Equal(t, 2, info.PrimaryShards)
+		assert.Equal(t, 0, info.ReplicaShards)
+		assert.Equal(t, "open", info.Status)
+		assert.Equal(t, "green", info.Health)
+		assert.True(t, info.StoreSize > 0)
+	}
+
+	shards, err := h.CatShards(ctx)
+	if assert.NoError(t, err) && assert.Len(t, shards, 2) {
+		docs := 0
+		for _, s := range shards {
+			assert.True(t, s.Primary)
+			assert.Equal(t, "STARTED", s.State)
+			docs += s.DocCount
+		}
+		assert.Equal(t, 2, docs)
+	}
+
+	// All shards are started, no recovery is in progress
+	recoveries, err := h.RecoveryStatus(ctx)
+	if assert.NoError(t, err) {
+		assert.Len(t, recoveries, 0)
+	}
+}
@@ -0,0 +1,215 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// WaitForReady blocks until the cluster health of the handler's index reaches
+// status ("green", "yellow" or "red"). If the context has a deadline, ES is
+// asked to wait until this deadline and context.DeadlineExceeded is returned if
+// the status is not reached in time, whether ES or the client times out first.
+// Without deadline, ES default timeout of 30 seconds applies.
+func (h *Handler) WaitForReady(ctx context.Context, status string) error {
+	switch status {
+	case "green", "yellow", "red":
+	default:
+		return fmt.Errorf("wait for ready invalid status: %q", status)
+	}
+	s := h.client.ClusterHealth().Index(h.index).WaitForStatus(status)
+	// Apply context deadline if any
+	if t := ctxTimeout(ctx); t != "" {
+		s.Timeout(t)
+	}
+	res, err := s.Do(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !translateError(&err) {
+			err = fmt.Errorf("wait for ready error (index=%s): %v", h.index, err)
+		}
+		return err
+	}
+	if res.TimedOut {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// CheckVersion returns the version of the ES cluster (i.e.: "5.6.3") as
+// reported by the node the client is connected to.
+func (h *Handler) CheckVersion(ctx context.Context) (string, error) {
+	res, err := h.client.PerformRequest(ctx, "GET", "/", nil, nil)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("check version error: %v", err)
+		}
+		return "", err
+	}
+	info := struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}{}
+	if err := json.Unmarshal(res.Body, &info); err != nil {
+		return "", fmt.Errorf("check version unmarshaling error: %v", err)
+	}
+	return info.Version.Number, nil
+}
+
+// RequireVersion returns an error if the version of the ES cluster is lower
+// than minVersion (i.e.: "5.3.0"). It is meant to be called at startup to
+// fail early when deployed against an incompatible cluster, see also
+// WithVersionCheck.
+func (h *Handler) RequireVersion(ctx context.Context, minVersion string) error {
+	v, err := h.CheckVersion(ctx)
+	if err != nil {
+		return err
+	}
+	cmp, err := compareVersions(v, minVersion)
+	if err != nil {
+		return err
+	}
+	if cmp < 0 {
+		return fmt.Errorf("unsupported ES version %s, %s or higher required", v, minVersion)
+	}
+	return nil
+}
+
+// compareVersions compares the a and b semver versions and returns -1, 0 or 1
+// if a is respectively lower, equal or greater than b. Missing components are
+// considered as 0 and only the first three components are compared (i.e.:
+// "5.6.3.1" equals "5.6.3"). As with semver, a pre-release is lower than its
+// release (i.e.: "6.0.0-beta1" is lower than "6.0.0") and build metadata is
+// ignored.
+func compareVersions(a, b string) (int, error) {
+	parse := func(v string) ([3]int, string, error) {
+		var n [3]int
+		if i := strings.IndexByte(v, '+'); i >= 0 {
+			v = v[:i]
+		}
+		pre := ""
+		if i := strings.IndexByte(v, '-'); i >= 0 {
+			v, pre = v[:i], v[i+1:]
+		}
+		for i, c := range strings.Split(v, ".") {
+			if i >= len(n) {
+				break
+			}
+			var err error
+			if n[i], err = strconv.Atoi(c); err != nil {
+				return n, "", fmt.Errorf("invalid version: %q", v)
+			}
+		}
+		return n, pre, nil
+	}
+	na, prea, err := parse(a)
+	if err != nil {
+		return 0, err
+	}
+	nb, preb, err := parse(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range na {
+		if na[i] < nb[i] {
+			return -1, nil
+		} else if na[i] > nb[i] {
+			return 1, nil
+		}
+	}
+	switch {
+	case prea == preb:
+		return 0, nil
+	case prea == "":
+		return 1, nil
+	case preb == "":
+		return -1, nil
+	}
+	return comparePreReleases(prea, preb), nil
+}
+
+// comparePreReleases compares the a and b pre-release versions as defined by
+// semver: dot separated identifiers are compared in turn, numerically if both
+// are numbers and lexically otherwise, numbers being lower than other
+// identifiers. If all identifiers are equal, the version having the fewer
+// identifiers is the lower one.
+func comparePreReleases(a, b string) int {
+	ia, ib := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(ia) && i < len(ib); i++ {
+		na, erra := strconv.Atoi(ia[i])
+		nb, errb := strconv.Atoi(ib[i])
+		switch {
+		case erra == nil && errb == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		case erra == nil:
+			return -1
+		case errb == nil:
+			return 1
+		default:
+			if c := strings.Compare(ia[i], ib[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	switch {
+	case len(ia) < len(ib):
+		return -1
+	case len(ia) > len(ib):
+		return 1
+	}
+	return 0
+}
+
+// recoveryThrottleSetting is the cluster setting limiting the bandwidth used
+// by each node to recover shards.
+const recoveryThrottleSetting = "indices.recovery.max_bytes_per_sec"
+
+// SetRecoveryThrottle limits the bandwidth used by each node of the cluster to
+// recover shards to mbps megabytes per second. It is meant to prevent recovery
+// after a node failure from overloading the other nodes during maintenance
+// windows. The setting is transient, it is thus lost on full cluster restart.
+//
+// Note that this is a cluster wide setting, it affects all the indices, not
+// only the handler's one.
+func (h *Handler) SetRecoveryThrottle(ctx context.Context, mbps int) error {
+	if mbps <= 0 {
+		return fmt.Errorf("set recovery throttle invalid rate: %d", mbps)
+	}
+	return h.putRecoveryThrottle(ctx, fmt.Sprintf("%dmb", mbps))
+}
+
+// DisableRecoveryThrottle resets the recovery bandwidth limit set by
+// SetRecoveryThrottle to the ES default (40mb per second).
+func (h *Handler) DisableRecoveryThrottle(ctx context.Context) error {
+	return h.putRecoveryThrottle(ctx, nil)
+}
+
+// putRecoveryThrottle sets the transient recovery throttle setting to value,
+// a nil value resetting it to its default.
+//
+// The elastic client does not provide a cluster settings service, so the
+// cluster settings API is queried directly.
+func (h *Handler) putRecoveryThrottle(ctx context.Context, value interface{}) error {
+	body := map[string]interface{}{
+		"transient": map[string]interface{}{
+			recoveryThrottleSetting: value,
+		},
+	}
+	if _, err := h.client.PerformRequest(ctx, "PUT", "/_cluster/settings", nil, body); err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("recovery throttle error: %v", err)
+		}
+		return err
+	}
+	return nil
+}
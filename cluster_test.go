@@ -0,0 +1,177 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestWaitForReadyInvalidStatus(t *testing.T) {
+	h := NewHandler(nil, "index", "type")
+	assert.EqualError(t, h.WaitForReady(context.Background(), "blue"), `wait for ready invalid status: "blue"`)
+}
+
+func TestWaitForReady(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testwaitforready")()
+	h := NewHandler(c, "testwaitforready", "test", WithIndexSettings(map[string]interface{}{
+		"number_of_replicas": 0,
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	assert.NoError(t, h.WaitForReady(ctx, "green"))
+
+	// Replicas can't be allocated on a single node cluster
+	h = NewHandler(c, "testwaitforready2", "test", WithIndexSettings(map[string]interface{}{
+		"number_of_replicas": 1,
+	}))
+	defer cleanup(c, "testwaitforready2")()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	sctx, scancel := context.WithTimeout(context.Background(), time.Second)
+	defer scancel()
+	assert.Equal(t, context.DeadlineExceeded, h.WaitForReady(sctx, "green"))
+}
+
+func TestWaitForReadyDeadline(t *testing.T) {
+	// The server never answers before the client gives up
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	c, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(c, "index", "type")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, h.WaitForReady(ctx, "green"))
+}
+
+func TestWithVersionCheck(t *testing.T) {
+	paths := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"version":{"number":"5.0.0-beta1"}}`))
+	}))
+	defer ts.Close()
+	c, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(c, "index", "type", WithVersionCheck("5.0.0"))
+	err = h.EnsureIndex(context.Background())
+	assert.EqualError(t, err, "unsupported ES version 5.0.0-beta1, 5.0.0 or higher required")
+	// The index is not created
+	assert.Equal(t, []string{"/"}, paths)
+}
+
+func TestSetRecoveryThrottleInvalidRate(t *testing.T) {
+	h := NewHandler(nil, "index", "type")
+	assert.EqualError(t, h.SetRecoveryThrottle(context.Background(), 0), "set recovery throttle invalid rate: 0")
+}
+
+func TestRecoveryThrottle(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(c, "testrecoverythrottle", "test")
+	ctx := context.TODO()
+	getThrottle := func() interface{} {
+		res, err := c.PerformRequest(ctx, "GET", "/_cluster/settings", url.Values{"flat_settings": []string{"true"}}, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		settings := struct {
+			Transient map[string]interface{} `json:"transient"`
+		}{}
+		assert.NoError(t, json.Unmarshal(res.Body, &settings))
+		return settings.Transient[recoveryThrottleSetting]
+	}
+	defer h.DisableRecoveryThrottle(ctx)
+
+	assert.NoError(t, h.SetRecoveryThrottle(ctx, 20))
+	assert.Equal(t, "20mb", getThrottle())
+	assert.NoError(t, h.DisableRecoveryThrottle(ctx))
+	assert.Nil(t, getThrottle())
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"5.6.3", "5.6.3", 0},
+		{"5.6.3", "5.3.0", 1},
+		{"5.2.2", "5.3.0", -1},
+		{"10.0.0", "9.1.1", 1},
+		{"6.0.0-beta1", "6.0.0", -1},
+		{"6.0.0", "6.0.0-rc1", 1},
+		{"6.0.0-beta1", "6.0.0-beta2", -1},
+		{"6.0.0-rc1", "6.0.0-beta2", 1},
+		{"6.0.0-beta1", "6.0.0-beta1", 0},
+		{"6.0.0-alpha.1", "6.0.0-alpha.2", -1},
+		{"6.0.0-alpha.10", "6.0.0-alpha.2", 1},
+		{"6.0.0-alpha.1", "6.0.0-alpha.beta", -1},
+		{"6.0.0-alpha", "6.0.0-alpha.1", -1},
+		{"6.0.0-beta1+build.5", "6.0.0-beta1", 0},
+		{"6.0.0+build.5", "6.0.0", 0},
+		{"5.6", "5.6.0", 0},
+		{"5.6.3.1", "5.6.3", 0},
+		{"5.6.3.1", "5.6.4", -1},
+		{"5.6.4", "5.6.3.9", 1},
+		{"5.6.3.1-beta1", "5.6.3", -1},
+		{"6.0.0-rc1", "5.6.3.1", 1},
+		{"6.0.0-alpha1+build.5", "6.0.1", -1},
+	}
+	for _, tc := range cases {
+		got, err := compareVersions(tc.a, tc.b)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, got, "%s vs %s", tc.a, tc.b)
+	}
+	_, err := compareVersions("5.x", "5.0.0")
+	assert.EqualError(t, err, `invalid version: "5.x"`)
+	_, err = compareVersions("5.6.x.1", "5.0.0")
+	assert.EqualError(t, err, `invalid version: "5.6.x.1"`)
+}
+
+func TestCheckVersion(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(c, "testcheckversion", "test")
+	ctx := context.TODO()
+	v, err := h.CheckVersion(ctx)
+	if assert.NoError(t, err) {
+		assert.True(t, strings.HasPrefix(v, "5."))
+	}
+	assert.NoError(t, h.RequireVersion(ctx, "5.0.0"))
+	assert.Error(t, h.RequireVersion(ctx, "99.0.0"))
+}
@@ -0,0 +1,114 @@
+package es
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+type ctxKey int
+
+const (
+	postFilterCtxKey ctxKey = iota
+	aggregationsCtxKey
+	esOptionsCtxKey
+)
+
+// WithPostFilter returns a context instructing the handler to apply the
+// predicate of q as a post_filter when searching. A post filter restricts the
+// returned items after aggregations are computed, so facets keep counting the
+// items matching the main query only (i.e.: faceted search with selected
+// facet values).
+func WithPostFilter(ctx context.Context, q *query.Query) context.Context {
+	return context.WithValue(ctx, postFilterCtxKey, q)
+}
+
+// postFilterFromContext returns the post filter query stored in ctx if any.
+func postFilterFromContext(ctx context.Context) (*query.Query, bool) {
+	q, ok := ctx.Value(postFilterCtxKey).(*query.Query)
+	return q, ok && q != nil
+}
+
+// aggregationsHolder carries the aggregations requested with WithAggregations
+// and receives their results once the search is performed.
+type aggregationsHolder struct {
+	aggs   map[string]elastic.Aggregation
+	result elastic.Aggregations
+}
+
+// WithAggregations returns a context instructing Find to compute aggs along
+// with the items. The raw aggregation results can be retrieved from the
+// returned context with AggregationsFromContext once Find returned.
+func WithAggregations(ctx context.Context, aggs map[string]elastic.Aggregation) context.Context {
+	return context.WithValue(ctx, aggregationsCtxKey, &aggregationsHolder{aggs: aggs})
+}
+
+// AggregationsFromContext returns the aggregation results of the last Find
+// performed with ctx, or nil if ctx was not created by WithAggregations or no
+// search has been performed yet.
+func AggregationsFromContext(ctx context.Context) elastic.Aggregations {
+	if ah := aggregationsFromContext(ctx); ah != nil {
+		return ah.result
+	}
+	return nil
+}
+
+// aggregationsFromContext returns the aggregations holder stored in ctx if any.
+func aggregationsFromContext(ctx context.Context) *aggregationsHolder {
+	ah, _ := ctx.Value(aggregationsCtxKey).(*aggregationsHolder)
+	return ah
+}
+
+// ESRequestOptions holds per-request ES options, overriding the handler
+// settings for the operations performed with a context created by
+// WithESOptions.
+type ESRequestOptions struct {
+	// Routing, when set, is the routing key restricting Find, its variants
+	// and Clear to the shard holding it, overriding DefaultRouting.
+	Routing string
+	// Preference, when set, is the search preference of Find, its variants
+	// and MultiGet, overriding Preference (see WithSessionPreference).
+	Preference string
+	// DryRun, when true, makes Insert, Update and Delete perform their
+	// checks without writing anything, and Clear return the number of items
+	// it would delete.
+	DryRun bool
+	// QueryCache, when set, enables or disables the shard request cache for
+	// Find and its variants.
+	QueryCache *bool
+	// MinScore, when set, excludes the items with a lower relevance score
+	// from the results of Find and its variants. Scores are only computed
+	// with ForceQueryContext.
+	MinScore *float64
+}
+
+// WithESOptions returns a context carrying opts, replacing the options
+// previously set in ctx if any.
+func WithESOptions(ctx context.Context, opts ESRequestOptions) context.Context {
+	return context.WithValue(ctx, esOptionsCtxKey, opts)
+}
+
+// GetESOptions returns the ES options stored in ctx, or zero options if none.
+func GetESOptions(ctx context.Context) ESRequestOptions {
+	opts, _ := ctx.Value(esOptionsCtxKey).(ESRequestOptions)
+	return opts
+}
+
+// WithSessionPreference returns a context making Find and MultiGet use a
+// search preference derived from sessionID, so all the reads of a session are
+// served by the same shard copies. It avoids a session seeing results going
+// back and forth while replicas are being refreshed. The preference is set as
+// the Preference of the ES options of ctx.
+//
+// The preference is session_ followed by a hash of sessionID, ES rejecting
+// custom preferences starting with an underscore.
+func WithSessionPreference(ctx context.Context, sessionID string) context.Context {
+	h := fnv.New64a()
+	h.Write([]byte(sessionID))
+	opts := GetESOptions(ctx)
+	opts.Preference = fmt.Sprintf("session_%x", h.Sum64())
+	return WithESOptions(ctx, opts)
+}
@@ -0,0 +1,97 @@
+package es
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestPostFilterFromContext(t *testing.T) {
+	ctx := context.Background()
+	_, ok := postFilterFromContext(ctx)
+	assert.False(t, ok)
+	q, err := query.New("", `{name:"a"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pf, ok := postFilterFromContext(WithPostFilter(ctx, q))
+	assert.True(t, ok)
+	assert.Equal(t, q, pf)
+}
+
+func TestAggregationsFromContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, aggregationsFromContext(ctx))
+	assert.Nil(t, AggregationsFromContext(ctx))
+	aggs := map[string]elastic.Aggregation{"names": elastic.NewTermsAggregation().Field("name.keyword")}
+	ctx = WithAggregations(ctx, aggs)
+	if ah := aggregationsFromContext(ctx); assert.NotNil(t, ah) {
+		assert.Equal(t, aggs, ah.aggs)
+		ah.result = elastic.Aggregations{}
+	}
+	assert.Equal(t, elastic.Aggregations{}, AggregationsFromContext(ctx))
+}
+
+func TestSessionPreference(t *testing.T) {
+	ctx := context.Background()
+	h := &Handler{}
+	assert.Equal(t, "", h.preference(ctx))
+	h.Preference = "_local"
+	assert.Equal(t, "_local", h.preference(ctx))
+	sctx := WithSessionPreference(ctx, "abc")
+	p := h.preference(sctx)
+	assert.Regexp(t, regexp.MustCompile(`^session_[0-9a-f]+$`), p)
+	// The preference is stable for a given session
+	assert.Equal(t, p, GetESOptions(WithSessionPreference(ctx, "abc")).Preference)
+	assert.NotEqual(t, p, GetESOptions(WithSessionPreference(ctx, "abd")).Preference)
+}
+
+func TestESOptions(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, ESRequestOptions{}, GetESOptions(ctx))
+	minScore := 0.5
+	opts := ESRequestOptions{Routing: "a", DryRun: true, MinScore: &minScore}
+	ctx = WithESOptions(ctx, opts)
+	assert.Equal(t, opts, GetESOptions(ctx))
+	// The session preference is merged into the existing options
+	ctx = WithSessionPreference(ctx, "abc")
+	got := GetESOptions(ctx)
+	assert.Equal(t, "a", got.Routing)
+	assert.True(t, got.DryRun)
+	assert.NotEmpty(t, got.Preference)
+}
+
+func TestSearchRouting(t *testing.T) {
+	ctx := context.Background()
+	h := &Handler{ParentIDField: "post_id"}
+	q := &query.Query{Predicate: query.Predicate{&query.Equal{Field: "post_id", Value: "p1"}}}
+	assert.Equal(t, "p1", h.searchRouting(ctx, q))
+	h.DefaultRouting = "b"
+	assert.Equal(t, "b", h.searchRouting(ctx, q))
+	assert.Equal(t, "a", h.searchRouting(WithESOptions(ctx, ESRequestOptions{Routing: "a"}), q))
+}
+
+func TestTemplatable(t *testing.T) {
+	ctx := context.Background()
+	q := &query.Query{}
+	h := &Handler{}
+	assert.True(t, h.templatable(ctx, q))
+	assert.True(t, h.templatable(WithESOptions(ctx, ESRequestOptions{Preference: "_local"}), q))
+	assert.False(t, h.templatable(WithESOptions(ctx, ESRequestOptions{Routing: "a"}), q))
+	assert.False(t, h.templatable(WithPostFilter(ctx, &query.Query{}), q))
+	assert.False(t, h.templatable(WithAggregations(ctx, nil), q))
+	assert.False(t, h.templatable(ctx, &query.Query{Projection: query.Projection{{Name: "name"}}}))
+	assert.False(t, (&Handler{DefaultRouting: "a"}).templatable(ctx, q))
+	assert.False(t, (&Handler{CollapseField: "name"}).templatable(ctx, q))
+	assert.False(t, (&Handler{ShardTimeout: time.Second}).templatable(ctx, q))
+	h = &Handler{ParentIDField: "post_id"}
+	pq, err := query.New("", `{post_id:"p1"}`, "", nil)
+	if assert.NoError(t, err) {
+		assert.False(t, h.templatable(ctx, pq))
+	}
+}
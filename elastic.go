@@ -3,74 +3,572 @@ package es
 
 import (
 	"context"
+	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/rest-layer/resource"
 	"github.com/rs/rest-layer/schema/query"
 	"gopkg.in/olivere/elastic.v5"
 )
 
+// RefreshPolicy controls when the changes made by a write operation become
+// visible to searches. As RefreshPolicy is a string type, untyped constants
+// like "true" are still accepted, and strings can be converted with
+// RefreshPolicy(s).
+type RefreshPolicy string
+
+const (
+	// RefreshFalse does not refresh the index after a write, changes become
+	// visible with the next periodic refresh.
+	RefreshFalse RefreshPolicy = "false"
+	// RefreshTrue forces a refresh of the affected shards after each write.
+	// Forcing refreshes has performance impacts.
+	RefreshTrue RefreshPolicy = "true"
+	// RefreshWaitFor makes write operations wait for the changes to be made
+	// visible by the next periodic refresh without forcing one (requires ES
+	// 5.0+). Writes may block up to the index refresh interval.
+	RefreshWaitFor RefreshPolicy = "wait_for"
+)
+
 // Handler handles resource storage in an ElasticSearch index.
 type Handler struct {
 	client *elastic.Client
-	index  string
-	typ    string
-	// Refresh sets the refresh flag to true on all write operation to ensure
-	// writes are reflected into search results immediately after the operation.
-	// Setting this parameter to "true" has performance impacts.
-	Refresh string
+	// readClient, when set, is used for read operations, see WithReadClient.
+	readClient *elastic.Client
+	index      string
+	typ        string
+	// fieldTypes provides mapping information on fields, see
+	// WithFieldTypeProvider.
+	fieldTypes FieldTypeProvider
+	// minVersion is the minimum ES version required by EnsureIndex, see
+	// WithVersionCheck.
+	minVersion string
+	// templates maps query structures to precompiled search template names,
+	// see PrecompileQuery.
+	templates   map[string]string
+	templatesMu sync.RWMutex
+	// segmentsCheckedAt is the time of the last segment count check, see
+	// MaxSegments.
+	segmentsCheckedAt time.Time
+	segmentsMu        sync.Mutex
+	// Refresh sets the refresh policy of all write operations. Use RefreshTrue
+	// or RefreshWaitFor to ensure writes are reflected into search results
+	// immediately after the operation. Default is RefreshFalse.
+	Refresh RefreshPolicy
+	// DocumentFilter, when set, returns a query restricting the items visible
+	// by the request of ctx (i.e.: the items of the tenant of the
+	// authenticated user), as an application level alternative to X-Pack
+	// document level security. The query is combined with the queries of
+	// Find, its variants and Clear, and MultiGet drops the items not matching
+	// it. A nil query does not restrict anything.
+	DocumentFilter func(ctx context.Context) *query.Query
+	// ValidateDocumentFilter, when true, makes Insert and RunBatch fail with
+	// resource.ErrForbidden if an item does not match the DocumentFilter
+	// query.
+	ValidateDocumentFilter bool
+	// Preference, when set, is the search preference controlling which shard
+	// copies serve Find and MultiGet (i.e.: "_local" or "_primary"). It is
+	// overridden by the preference of the ES options set with WithESOptions
+	// or WithSessionPreference.
+	Preference string
+	// DefaultRouting, when set, is used as routing key by Find so only the
+	// shard holding documents with this routing key is searched.
+	DefaultRouting string
+	// RoutingField, when set, is the payload field used as routing key when
+	// storing items, so items sharing the same value are stored on the same
+	// shard. The field must not change once the item is created. As the routing
+	// key can't be derived from an id, MultiGet falls back to a search hitting
+	// all shards, like Find does unless DefaultRouting is set.
+	RoutingField string
+	// ParentIDField, when set, is the payload field holding the id of the
+	// parent of child items (i.e.: the post of a comment). Children are
+	// routed with their parent id so they are stored on the shard of their
+	// parent, while items without parent keep the default routing on their
+	// own id. ParentIDField takes precedence over RoutingField. Find only
+	// searches the parent's shard when the query filters on a single parent
+	// id at its root (i.e.: {post_id:"1"}), and MultiGet falls back to a
+	// search hitting all shards.
+	ParentIDField string
+	// ForceQueryContext makes Find execute queries in query context instead of
+	// filter context. In query context, ES computes a relevance score for each
+	// item, but can't cache the queries.
+	ForceQueryContext bool
+	// QueryName, when set, names all the leaf queries translated from query
+	// predicates (i.e.: term and range queries) so they can be identified
+	// when profiling or explaining ES queries. See NamedExpression to name
+	// individual expressions.
+	QueryName string
+	// NestedPaths lists the fields mapped with the nested type. Queries on
+	// sub-fields of those paths (i.e.: author.name for the author path) are
+	// wrapped into nested queries on the deepest matching path, while other
+	// dotted fields are queried as plain object fields.
+	NestedPaths []string
+	// IntegerFields lists the fields mapped with an integer type. Range
+	// query values on those fields, decoded as float64 from JSON, are
+	// converted to integers, fractional bounds being rounded so the range
+	// matches the same integers.
+	IntegerFields []string
+	// SortDefaults lists the fields sorted in reverse order by default (i.e.:
+	// dates, newest first). The order of the listed fields is inverted: a
+	// sort on "updated" returns the newest items first while "-updated"
+	// returns the oldest first.
+	SortDefaults map[string]bool
+	// CollapseField, when set, makes Find return only the top item for each
+	// distinct value of this field (requires ES 5.3+).
+	CollapseField string
+	// CollapseInnerHitsSize, when greater than 0 and CollapseField is set, adds
+	// up to this number of items of each group to the payload of the group's
+	// top item under the "_inner_hits" key, as a []*resource.Item.
+	CollapseInnerHitsSize int
+	// SourceDisabled, when true, makes Find only return the metadata of the
+	// matching items (ID, ETag and Updated) with an empty payload, saving the
+	// transfer of the documents' source.
+	SourceDisabled bool
+	// SourceIncludes, when set, restricts the document fields returned by
+	// Find and MultiGet to the listed fields (wildcards are supported).
+	SourceIncludes []string
+	// SourceExcludes lists document fields never returned by Find and
+	// MultiGet (i.e.: internal fields or secrets), whatever the requested
+	// projection.
+	SourceExcludes []string
+	// MaxRetries is the number of times a bulk operation, or the items of a
+	// bulk operation, rejected by ES with a 429 Too Many Requests error are
+	// retried. Default is 0 (no retry).
+	MaxRetries int
+	// RetryBackoff returns the duration to wait before the given retry attempt
+	// (starting at 0). If nil, an exponential backoff starting at 100ms is
+	// used.
+	RetryBackoff func(attempt int) time.Duration
+	// IndexSettings holds the settings (i.e.: number_of_shards, analysis) used
+	// when the index is created by EnsureIndex.
+	IndexSettings map[string]interface{}
+	// FielddataFields lists the text fields mapped with fielddata enabled
+	// when the index is created by EnsureIndex, allowing terms aggregations
+	// and sorting on analyzed text fields without keyword sub-field. Fielddata
+	// is loaded in the JVM heap for all the terms of the field and kept until
+	// evicted, which can use a lot of memory on high cardinality fields.
+	FielddataFields []string
+	// NormalizeKeywords, when true, makes EnsureIndex map dynamically mapped
+	// string fields with a lowercase normalized .keyword sub-field, so exact
+	// match queries and sorts on string fields are case-insensitive (requires
+	// ES 5.2+). See EnsureNormalizerSettings for existing indices.
+	NormalizeKeywords bool
+	// Pipeline, when set, is the ingest pipeline processing the documents
+	// created by Insert, InsertWithVersion and the RunBatch inserts. Updates
+	// go through the update API, which does not run ingest pipelines.
+	Pipeline string
+	// GeoIPFields maps payload fields holding IP addresses to the fields
+	// receiving their geo location, see EnsureGeoIPPipeline.
+	GeoIPFields map[string]string
+	// SuggestFields maps payload fields to completion suggester fields (i.e.:
+	// "name" -> "name_suggest"). When an item is stored, the value of each
+	// field is added as the input of its suggester field, keeping the
+	// suggester up to date. Suggester fields must be mapped with the
+	// completion type and are never returned in items' payload.
+	SuggestFields map[string]string
+	// AutoGenerateID, when true, makes Insert let ES generate the id of the
+	// items having a nil or empty ID. The generated ids are set to the ID and
+	// the id payload field of the inserted items once Insert returned.
+	AutoGenerateID bool
+	// ShardTimeout, when set, is sent to ES as the timeout each shard has to
+	// perform its part of the operation, while the context deadline is used as
+	// the HTTP request deadline. When only one of them is set, it is used for
+	// both.
+	ShardTimeout time.Duration
+	// ClearConflicts sets how Clear handles documents modified concurrently
+	// while being deleted: "abort" (the default) fails with
+	// resource.ErrConflict while "proceed" deletes the other documents and
+	// reports the conflicts (see ClearWithConflicts).
+	ClearConflicts string
+	// TypeSelector, when set, returns the types searched by Find for a query
+	// in multi-type indices (i.e.: the draft type for queries on draft
+	// items). An empty list selects the handler's type. Write operations and
+	// MultiGet always use the handler's type.
+	TypeSelector func(q *query.Query) []string
+	// IndexSelector, when set, returns the index storing an item, allowing
+	// items to be partitioned over several indices (i.e.: one index per day
+	// for time series, see DateRollingPattern). Writes go to the selected
+	// index while Find, Clear and MultiGet use the handler's index, which
+	// should thus be an alias or a wildcard index pattern covering all the
+	// selected indices. An empty string selects the handler's index.
+	IndexSelector IndexPattern
+	// MaxSegments, when set with OnTooManySegments, makes Find check the
+	// segment count of the index (see SegmentCount) and call
+	// OnTooManySegments when it exceeds MaxSegments, signaling the index needs
+	// a force merge. The check is performed in the background at most once
+	// per SegmentCheckInterval.
+	MaxSegments int
+	// OnTooManySegments is called with the segment count of the index when
+	// it exceeds MaxSegments (i.e.: to log a warning).
+	OnTooManySegments func(count int)
+	// SegmentCheckInterval is the minimum duration between two segment count
+	// checks. Default is one minute.
+	SegmentCheckInterval time.Duration
+	// OnOverloaded is called by NodeStats with each overloaded node (see
+	// NodeInfo.Overloaded), i.e.: to log a warning.
+	OnOverloaded func(node NodeInfo)
+	// OnExpired is called by the expiry worker (see StartExpiryWorker) after
+	// each cleanup with the number of deleted items or the cleanup error
+	// (i.e.: to log them).
+	OnExpired func(n int, err error)
 }
 
 // NewHandler creates an new ElasticSearch storage handler for the given
 // index/type
-func NewHandler(client *elastic.Client, index, typ string) *Handler {
-	return &Handler{
+func NewHandler(client *elastic.Client, index, typ string, opts ...HandlerOption) *Handler {
+	h := &Handler{
 		client:  client,
 		index:   index,
 		typ:     typ,
-		Refresh: "false",
+		Refresh: RefreshFalse,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
-// Insert inserts new items in the ElasticSearch index
+// Insert inserts new items in the ElasticSearch index. If some items fail to be
+// inserted, a *BulkError is returned, for which IsConflict returns true if all
+// failures are due to existing items. When IndexSelector is set, one bulk
+// operation is performed per destination index.
 func (h *Handler) Insert(ctx context.Context, items []*resource.Item) error {
-	bulk := h.client.Bulk()
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	if err := h.validateDocumentFilter(ctx, items); err != nil {
+		return err
+	}
+	bulks := map[string][]elastic.BulkableRequest{}
+	positions := map[string][]int{}
+	indices := []string{}
+	for i, item := range items {
+		id, err := h.itemID(item, true)
+		if err != nil {
+			return err
+		}
+		index := h.itemIndex(item)
+		if _, found := bulks[index]; !found {
+			indices = append(indices, index)
+		}
+		bulks[index] = append(bulks[index], h.insertRequest(index, id, item))
+		positions[index] = append(positions[index], i)
+	}
+	if GetESOptions(ctx).DryRun {
+		return nil
+	}
+	errs := []BulkItemError{}
+	for _, index := range indices {
+		res, err := h.doBulk(ctx, bulks[index])
+		if err != nil {
+			if !translateError(&err) {
+				err = fmt.Errorf("insert error (index=%s): %v", index, err)
+			}
+			return err
+		}
+		errs = append(errs, bulkItemErrors(res, positions[index])...)
+		if h.AutoGenerateID {
+			setGeneratedIDs(res, items, positions[index])
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+	// CAVEAT on a bulk insert, if some items are in error, the operation is not
+	// atomic and the request will partially succeed. I don't see how to perform
+	// atomic bulk insert with ES.
+	return newBulkError(errs)
+}
+
+// validateDocumentFilter returns resource.ErrForbidden if
+// ValidateDocumentFilter is set and one of the items does not match the
+// DocumentFilter query for ctx.
+func (h *Handler) validateDocumentFilter(ctx context.Context, items []*resource.Item) error {
+	if !h.ValidateDocumentFilter {
+		return nil
+	}
+	if f := h.documentFilter(ctx); f != nil {
+		for _, item := range items {
+			if !f.Predicate.Match(item.Payload) {
+				return resource.ErrForbidden
+			}
+		}
+	}
+	return nil
+}
+
+// itemID returns the id of item. If generated is true and AutoGenerateID is
+// set, an item without id is accepted and an empty id is returned.
+func (h *Handler) itemID(item *resource.Item, generated bool) (string, error) {
+	id, ok := item.ID.(string)
+	if !ok && !(generated && h.AutoGenerateID && item.ID == nil) {
+		return "", errors.New("non string IDs are not supported with ElasticSearch")
+	}
+	return id, nil
+}
+
+// insertRequest returns the bulk request creating item with the given id in
+// index, or with an id generated by ES if id is empty and AutoGenerateID is
+// set.
+func (h *Handler) insertRequest(index, id string, item *resource.Item) *elastic.BulkIndexRequest {
+	req := elastic.NewBulkIndexRequest().Index(index).Type(h.typ).Doc(buildDoc(item, h.SuggestFields))
+	if h.Pipeline != "" {
+		req.Pipeline(h.Pipeline)
+	}
+	// Without id, ES generates one, which requires the index op type (the
+	// document is created anyway)
+	if id != "" || !h.AutoGenerateID {
+		req.OpType("create").Id(id)
+	}
+	if r := h.routing(item); r != "" {
+		req.Routing(r)
+	}
+	return req
+}
+
+// InsertIfNotExists inserts item unless an item with the same values for all
+// the uniqueFields payload fields (i.e.: tenant and email) already exists in
+// the handler's index, in which case false is returned. The unique fields must
+// be set in the item payload.
+//
+// CAVEAT the check and the insert are two separate operations: an item with
+// the same values inserted concurrently, or not yet visible to searches when
+// Refresh is RefreshFalse, is not detected. When the unique fields can be
+// turned into the item id, Insert, which fails with resource.ErrConflict if
+// the id exists, is the reliable alternative.
+func (h *Handler) InsertIfNotExists(ctx context.Context, item *resource.Item, uniqueFields []string) (created bool, err error) {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	p := query.Predicate{}
+	for _, f := range uniqueFields {
+		v, found := item.Payload[f]
+		if !found || v == nil {
+			return false, fmt.Errorf("insert if not exists missing unique field %q (index=%s, type=%s)", f, h.index, h.typ)
+		}
+		p = append(p, &query.Equal{Field: f, Value: v})
+	}
+	qs, err := h.translatePredicate(p)
+	if err != nil {
+		return false, fmt.Errorf("insert if not exists query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+	}
+	// Always check on the main cluster, a read cluster may lag behind
+	n, err := h.client.Count(h.index).Type(h.typ).Query(elastic.NewBoolQuery().Must(qs...)).Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("insert if not exists count error (index=%s, type=%s): %v", h.index, h.typ, err)
+		}
+		// The index is created by the insert
+		if err != resource.ErrNotFound {
+			return false, err
+		}
+	} else if n > 0 {
+		return false, nil
+	}
+	if err := h.Insert(ctx, []*resource.Item{item}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setGeneratedIDs sets the id generated by ES to the items stored without id,
+// positions giving the position in items of each bulk response item.
+func setGeneratedIDs(res *elastic.BulkResponse, items []*resource.Item, positions []int) {
+	for i, ri := range res.Items {
+		if i >= len(positions) {
+			break
+		}
+		item := items[positions[i]]
+		if id, _ := item.ID.(string); id != "" {
+			continue
+		}
+		for _, r := range ri {
+			if r.Error != nil {
+				continue
+			}
+			item.ID = r.Id
+			if item.Payload != nil {
+				item.Payload["id"] = r.Id
+			}
+		}
+	}
+}
+
+// doBulk performs reqs in a single bulk operation, applying the ctx deadline
+// and the Refresh policy. When ES is overloaded, it rejects either the whole
+// operation with a 429 Too Many Requests error or, more commonly, some of its
+// items with a 429 status (es_rejected_execution_exception). Both are retried
+// up to MaxRetries times, only the rejected items being sent again. The
+// returned response holds the last result of each request, in reqs order. If a
+// retry fails with another error, this error is returned along with the
+// response of the previous attempts, in which the items not sent again are
+// still reported as rejected.
+func (h *Handler) doBulk(ctx context.Context, reqs []elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+	var res *elastic.BulkResponse
+	// pending holds the position in reqs of the requests to send
+	pending := make([]int, len(reqs))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 0; ; attempt++ {
+		bulk := h.client.Bulk()
+		for _, i := range pending {
+			bulk.Add(reqs[i])
+		}
+		// Apply context deadline if any
+		if t := h.timeout(ctx); t != "" {
+			bulk.Timeout(t)
+		}
+		// Set the refresh flag to true if requested
+		bulk.Refresh(string(h.Refresh))
+		r, err := bulk.Do(ctx)
+		if err != nil {
+			if !isTooManyRequests(err) || attempt >= h.MaxRetries {
+				if res != nil && isTooManyRequests(err) {
+					// The items still rejected are reported by res
+					return res, nil
+				}
+				return res, err
+			}
+		} else {
+			if res == nil {
+				res = r
+			} else {
+				mergeBulkResponse(res, r, pending)
+			}
+			pending = rejectedBulkItems(r, pending)
+			if len(pending) == 0 || attempt >= h.MaxRetries {
+				return res, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(h.retryBackoff(attempt)):
+		}
+	}
+}
+
+// retryBackoff returns the duration to wait before the given retry attempt,
+// as returned by RetryBackoff if set or doubling from 100ms otherwise.
+func (h *Handler) retryBackoff(attempt int) time.Duration {
+	if h.RetryBackoff != nil {
+		return h.RetryBackoff(attempt)
+	}
+	return (100 * time.Millisecond) << uint(attempt)
+}
+
+// rejectedBulkItems returns the positions, among the original requests, of the
+// items of res rejected with a 429 status. The i-th item of res is the result
+// of the request at positions[i].
+func rejectedBulkItems(res *elastic.BulkResponse, positions []int) []int {
+	rejected := []int{}
+	if !res.Errors {
+		return rejected
+	}
+	for i, item := range res.Items {
+		for _, r := range item {
+			if r.Status == http.StatusTooManyRequests && i < len(positions) {
+				rejected = append(rejected, positions[i])
+			}
+		}
+	}
+	return rejected
+}
+
+// mergeBulkResponse replaces the items of res by the result of their retry in
+// retry. The i-th item of retry is the result of the request at positions[i].
+func mergeBulkResponse(res, retry *elastic.BulkResponse, positions []int) {
+	res.Took += retry.Took
+	for i, item := range retry.Items {
+		if i < len(positions) && positions[i] < len(res.Items) {
+			res.Items[positions[i]] = item
+		}
+	}
+	res.Errors = false
+	for _, item := range res.Items {
+		for _, r := range item {
+			if r.Error != nil {
+				res.Errors = true
+			}
+		}
+	}
+}
+
+// BulkUpsert stores items in the ElasticSearch index, creating the items that
+// don't exist and updating the others, without any etag check. Existing
+// documents are merged with the new payload, so fields absent from the new
+// payload are kept. This is meant for idempotent data synchronization.
+func (h *Handler) BulkUpsert(ctx context.Context, items []*resource.Item) error {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	reqs := make([]elastic.BulkableRequest, 0, len(items))
 	for _, item := range items {
 		id, ok := item.ID.(string)
 		if !ok {
 			return errors.New("non string IDs are not supported with ElasticSearch")
 		}
-		doc := buildDoc(item)
-		req := elastic.NewBulkIndexRequest().OpType("create").Index(h.index).Type(h.typ).Id(id).Doc(doc)
-		bulk.Add(req)
+		doc := buildDoc(item, h.SuggestFields)
+		req := elastic.NewBulkUpdateRequest().Index(h.itemIndex(item)).Type(h.typ).Id(id).Doc(doc).DocAsUpsert(true)
+		if r := h.routing(item); r != "" {
+			req.Routing(r)
+		}
+		reqs = append(reqs, req)
 	}
-	// Apply context deadline if any
-	if t := ctxTimeout(ctx); t != "" {
-		bulk.Timeout(t)
+	res, err := h.doBulk(ctx, reqs)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("upsert error: %v", err)
+		}
+		return err
 	}
-	// Set the refresh flag to true if requested
-	bulk.Refresh(h.Refresh)
-	res, err := bulk.Do(ctx)
+	return getBulkError(res)
+}
+
+// ItemWithVersion is a resource.Item with an explicit ES document version.
+type ItemWithVersion struct {
+	*resource.Item
+	// Version is the version of the document, typically the modification
+	// timestamp or sequence number of the item in the migrated data source.
+	Version int64
+}
+
+// InsertWithVersion stores items in the ElasticSearch index using external
+// versioning: an item is only written if its version is greater than the
+// version of the stored document. Replaying the same items is thus safe and
+// never overwrites newer data, the rejected items being reported as conflicts.
+// This is meant for data migration.
+func (h *Handler) InsertWithVersion(ctx context.Context, items []*ItemWithVersion) error {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	reqs := make([]elastic.BulkableRequest, 0, len(items))
+	for _, item := range items {
+		id, ok := item.ID.(string)
+		if !ok {
+			return errors.New("non string IDs are not supported with ElasticSearch")
+		}
+		doc := buildDoc(item.Item, h.SuggestFields)
+		req := elastic.NewBulkIndexRequest().Index(h.itemIndex(item.Item)).Type(h.typ).Id(id).Doc(doc).
+			VersionType("external").Version(item.Version)
+		if h.Pipeline != "" {
+			req.Pipeline(h.Pipeline)
+		}
+		if r := h.routing(item.Item); r != "" {
+			req.Routing(r)
+		}
+		reqs = append(reqs, req)
+	}
+	res, err := h.doBulk(ctx, reqs)
 	if err != nil {
 		if !translateError(&err) {
-			err = fmt.Errorf("insert error: %v", err)
-		}
-	} else if res.Errors {
-		for i, f := range res.Failed() {
-			// CAVEAT on a bulk insert, if some items are in error, the
-			// operation is not atomic and the request will partially succeed. I
-			// don't see how to perform atomic bulk insert with ES.
-			if isConflict(f.Error) {
-				err = resource.ErrConflict
-			} else {
-				err = fmt.Errorf("insert error on item #%d: %#v", i+1, f.Error)
-			}
-			break
+			err = fmt.Errorf("insert with version error: %v", err)
 		}
+		return err
 	}
-	return err
+	return getBulkError(res)
 }
 
 // Elastic Search provides it's own concurrency update mechanism using numerical
@@ -78,9 +576,13 @@ func (h *Handler) Insert(ctx context.Context, items []*resource.Item) error {
 // first get the document, ensures the etag is valid and use the ES document's
 // version to perform a conditional update. This function encapsulate this check
 // and return either an error or the document version.
-func (h *Handler) validateEtag(ctx context.Context, id, etag string) (int64, error) {
+func (h *Handler) validateEtag(ctx context.Context, index, id, etag, routing string) (int64, error) {
 	fsc := elastic.NewFetchSourceContext(true).Include(etagField)
-	res, err := h.client.Get().Index(h.index).Type(h.typ).Id(id).FetchSourceContext(fsc).Do(ctx)
+	g := h.client.Get().Index(index).Type(h.typ).Id(id).FetchSourceContext(fsc)
+	if routing != "" {
+		g.Routing(routing)
+	}
+	res, err := g.Do(ctx)
 	if err != nil {
 		if !translateError(&err) {
 			err = fmt.Errorf("etag check error: %v", err)
@@ -97,11 +599,15 @@ func (h *Handler) validateEtag(ctx context.Context, id, etag string) (int64, err
 
 // Update replace an item by a new one in the ElasticSearch index
 func (h *Handler) Update(ctx context.Context, item *resource.Item, original *resource.Item) error {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
 	id, ok := original.ID.(string)
 	if !ok {
 		return errors.New("non string IDs are not supported with ElasticSearch")
 	}
-	ver, err := h.validateEtag(ctx, id, original.ETag)
+	index := h.itemIndex(original)
+	routing := h.routing(original)
+	ver, err := h.validateEtag(ctx, index, id, original.ETag, routing)
 	if err != nil {
 		return err
 	}
@@ -109,12 +615,18 @@ func (h *Handler) Update(ctx context.Context, item *resource.Item, original *res
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
-	doc := buildDoc(item)
-	u := h.client.Update().Index(h.index).Type(h.typ)
+	if GetESOptions(ctx).DryRun {
+		return nil
+	}
+	doc := buildDoc(item, h.SuggestFields)
+	u := h.client.Update().Index(index).Type(h.typ)
+	if routing != "" {
+		u.Routing(routing)
+	}
 	// Set the refresh flag to requested value
-	u.Refresh(h.Refresh)
+	u.Refresh(string(h.Refresh))
 	// Apply context deadline if any
-	if t := ctxTimeout(ctx); t != "" {
+	if t := h.timeout(ctx); t != "" {
 		u.Timeout(t)
 	}
 	_, err = u.Id(id).Doc(doc).Version(ver).Do(ctx)
@@ -126,13 +638,84 @@ func (h *Handler) Update(ctx context.Context, item *resource.Item, original *res
 	return err
 }
 
+// ScriptUpdate atomically updates the item id in the handler's index with the
+// script painless script, using params as script parameters, if its current
+// etag is etag. It allows partial updates (i.e.: incrementing a counter)
+// without replacing the whole document. The script gets the document source
+// through ctx._source. As the new payload is not known, the item is given a new
+// etag derived from the previous one, and its updated date is set to now.
+//
+// As no item is provided, the handler's index is used with no routing key,
+// ScriptUpdate thus does not support IndexSelector, RoutingField nor
+// ParentIDField.
+func (h *Handler) ScriptUpdate(ctx context.Context, id, etag, script string, params map[string]interface{}) error {
+	return h.scriptUpdate(ctx, id, etag, script, params, true)
+}
+
+// Touch sets the updated date of the item id in the handler's index to now,
+// without changing its payload, if its current etag is etag (i.e.: to mark the
+// item as recently accessed). The etag of the item is left unchanged. Like
+// ScriptUpdate, Touch does not support IndexSelector, RoutingField nor
+// ParentIDField.
+func (h *Handler) Touch(ctx context.Context, id, etag string) error {
+	return h.scriptUpdate(ctx, id, etag, "", nil, false)
+}
+
+// scriptUpdate updates the item id with script if its current etag is etag,
+// also setting its updated date to now and, if newEtag is true, a new etag.
+func (h *Handler) scriptUpdate(ctx context.Context, id, etag, script string, params map[string]interface{}, newEtag bool) error {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	ver, err := h.validateEtag(ctx, h.index, id, etag, "")
+	if err != nil {
+		return err
+	}
+	// Check if context is still valid
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	p := make(map[string]interface{}, len(params)+2)
+	for k, v := range params {
+		p[k] = v
+	}
+	scripts := []string{}
+	if script != "" {
+		scripts = append(scripts, script)
+	}
+	if newEtag {
+		p["rest_layer_etag"] = fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s-%d", etag, ver))))
+		scripts = append(scripts, fmt.Sprintf("ctx._source.%s = params.rest_layer_etag", etagField))
+	}
+	p["rest_layer_updated"] = time.Now().UTC().Format(time.RFC3339Nano)
+	scripts = append(scripts, fmt.Sprintf("ctx._source.%s = params.rest_layer_updated", updatedField))
+	u := h.client.Update().Index(h.index).Type(h.typ)
+	// Set the refresh flag to requested value
+	u.Refresh(string(h.Refresh))
+	// Apply context deadline if any
+	if t := h.timeout(ctx); t != "" {
+		u.Timeout(t)
+	}
+	s := elastic.NewScript(strings.Join(scripts, "; ")).Lang("painless").Params(p)
+	_, err = u.Id(id).Script(s).Version(ver).Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("script update error: %v", err)
+		}
+	}
+	return err
+}
+
 // Delete deletes an item from the ElasticSearch index
 func (h *Handler) Delete(ctx context.Context, item *resource.Item) error {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
 	id, ok := item.ID.(string)
 	if !ok {
 		return errors.New("non string IDs are not supported with ElasticSearch")
 	}
-	ver, err := h.validateEtag(ctx, id, item.ETag)
+	index := h.itemIndex(item)
+	routing := h.routing(item)
+	ver, err := h.validateEtag(ctx, index, id, item.ETag, routing)
 	if err != nil {
 		return err
 	}
@@ -140,13 +723,19 @@ func (h *Handler) Delete(ctx context.Context, item *resource.Item) error {
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
-	d := h.client.Delete().Index(h.index).Type(h.typ)
+	if GetESOptions(ctx).DryRun {
+		return nil
+	}
+	d := h.client.Delete().Index(index).Type(h.typ)
+	if routing != "" {
+		d.Routing(routing)
+	}
 	// Apply context deadline if any
-	if t := ctxTimeout(ctx); t != "" {
+	if t := h.timeout(ctx); t != "" {
 		d.Timeout(t)
 	}
 	// Set the refresh flag to true if requested
-	d.Refresh(h.Refresh)
+	d.Refresh(string(h.Refresh))
 	_, err = d.Id(id).Version(ver).Do(ctx)
 	if err != nil {
 		if !translateError(&err) {
@@ -156,31 +745,205 @@ func (h *Handler) Delete(ctx context.Context, item *resource.Item) error {
 	return err
 }
 
+// SafeDelete deletes an item like Delete but succeeds if the item does not
+// exist, making deletes idempotent.
+func (h *Handler) SafeDelete(ctx context.Context, item *resource.Item) error {
+	if err := h.Delete(ctx, item); err != resource.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
 // Clear clears all items from the ElasticSearch index matching the lookup
 func (h *Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
-	return 0, resource.ErrNotImplemented
+	deleted, _, err := h.ClearWithConflicts(ctx, q)
+	return deleted, err
+}
+
+// ClearWithConflicts clears all items from the ElasticSearch index matching the
+// lookup like Clear, and returns the number of items which could not be
+// deleted due to version conflicts. Conflicts are only reported when
+// ClearConflicts is set to "proceed", otherwise resource.ErrConflict is
+// returned.
+func (h *Handler) ClearWithConflicts(ctx context.Context, q *query.Query) (deleted int, conflicts int, err error) {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	d := h.client.DeleteByQuery(h.index).Type(h.typ)
+	q = h.filterQuery(ctx, q)
+
+	// Apply context deadline if any
+	if t := h.timeout(ctx); t != "" {
+		d.Timeout(t)
+	}
+
+	// Apply query, delete by query requires one
+	qry, err := h.getQuery(q)
+	if err != nil {
+		return 0, 0, fmt.Errorf("clear query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+	}
+	if qry == nil {
+		qry = elastic.NewMatchAllQuery()
+	}
+	d.Query(qry)
+
+	// Only count the items to delete in dry run mode
+	if GetESOptions(ctx).DryRun {
+		return h.clearDryRun(ctx, q, qry)
+	}
+
+	// Apply routing
+	if r := h.searchRouting(ctx, q); r != "" {
+		d.Routing(r)
+	}
+
+	// Apply limit
+	if q.Window != nil && q.Window.Limit >= 0 {
+		d.Size(q.Window.Limit)
+	}
+
+	// Apply version conflicts handling
+	if h.ClearConflicts != "" {
+		d.Conflicts(h.ClearConflicts)
+	}
+
+	// Set the refresh flag to true if requested, delete by query does not
+	// support wait_for
+	if h.Refresh == RefreshWaitFor {
+		d.Refresh(string(RefreshTrue))
+	} else {
+		d.Refresh(string(h.Refresh))
+	}
+	res, err := d.Do(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, 0, ctx.Err()
+		}
+		if !translateError(&err) {
+			err = fmt.Errorf("clear error (index=%s, type=%s): %v", h.index, h.typ, err)
+		}
+		return 0, 0, err
+	}
+	return int(res.Deleted), int(res.VersionConflicts), nil
+}
+
+// clearDryRun returns the number of items Clear would delete for q, qry being
+// its translated query.
+func (h *Handler) clearDryRun(ctx context.Context, q *query.Query, qry elastic.Query) (deleted int, conflicts int, err error) {
+	c := h.client.Count(h.index).Type(h.typ).Query(qry)
+	if r := h.searchRouting(ctx, q); r != "" {
+		c.Routing(r)
+	}
+	n, err := c.Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("clear dry run error (index=%s, type=%s): %v", h.index, h.typ, err)
+		}
+		return 0, 0, err
+	}
+	if q.Window != nil && q.Window.Limit >= 0 && n > int64(q.Window.Limit) {
+		n = int64(q.Window.Limit)
+	}
+	return int(n), 0, nil
 }
 
 // Find items from the ElasticSearch index matching the provided lookup
 func (h *Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
-	s := h.client.Search().Index(h.index).Type(h.typ)
+	h.checkSegments()
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	q = h.filterQuery(ctx, q)
+	// Use a precompiled search template if one matches the query structure and
+	// the search does not need options templates do not handle
+	if h.templatable(ctx, q) {
+		if name, params := h.getTemplate(q); name != "" {
+			return h.findTemplate(ctx, name, params, h.searchTypes(q))
+		}
+	}
+
+	qry, err := h.getQuery(q)
+	if err != nil {
+		return nil, fmt.Errorf("find query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+	}
+	return h.find(ctx, q, qry)
+}
+
+// find performs a search with qry as query, and the sort and pagination
+// defined by q. The aggregations set in ctx, if any, are computed and their
+// results stored back in ctx.
+func (h *Handler) find(ctx context.Context, q *query.Query, qry elastic.Query) (*resource.ItemList, error) {
+	s, err := h.newSearch(ctx, q, qry)
+	if err != nil {
+		return nil, err
+	}
+	ah := aggregationsFromContext(ctx)
+	if ah != nil {
+		for name, agg := range ah.aggs {
+			s.Aggregation(name, agg)
+		}
+	}
+	res, err := h.search(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if ah != nil {
+		ah.result = res.Aggregations
+	}
+	return buildItemList(res)
+}
+
+// newSearch creates a search service with qry as query, and the sort and
+// pagination defined by q. The post filter set in ctx, if any, is applied.
+func (h *Handler) newSearch(ctx context.Context, q *query.Query, qry elastic.Query) (*elastic.SearchService, error) {
+	src, err := h.newSearchSource(ctx, q, qry)
+	if err != nil {
+		return nil, err
+	}
+	s := h.reader().Search().Index(h.index).Type(h.searchTypes(q)...).SearchSource(src)
+
+	// Apply routing
+	if r := h.searchRouting(ctx, q); r != "" {
+		s.Routing(r)
+	}
+	if p := h.preference(ctx); p != "" {
+		s.Preference(p)
+	}
+	if qc := GetESOptions(ctx).QueryCache; qc != nil {
+		s.RequestCache(*qc)
+	}
+	return s, nil
+}
+
+// newSearchSource creates the body of a search with qry as query, and the
+// sort, pagination and projection defined by q. The post filter set in ctx, if any, is applied.
+func (h *Handler) newSearchSource(ctx context.Context, q *query.Query, qry elastic.Query) (*elastic.SearchSource, error) {
+	s := elastic.NewSearchSource()
 
 	// Apply context deadline if any
-	if t := ctxTimeout(ctx); t != "" {
+	if t := h.timeout(ctx); t != "" {
 		s.Timeout(t)
 	}
 
 	// Apply query
-	qry, err := getQuery(q)
-	if err != nil {
-		return nil, fmt.Errorf("find query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
-	}
 	if qry != nil {
 		s.Query(qry)
 	}
+	if ms := GetESOptions(ctx).MinScore; ms != nil {
+		s.MinScore(*ms)
+	}
+
+	// Apply post filter
+	if pf, ok := postFilterFromContext(ctx); ok {
+		pfq, err := h.getQuery(pf)
+		if err != nil {
+			return nil, fmt.Errorf("find post filter translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+		}
+		if pfq != nil {
+			s.PostFilter(pfq)
+		}
+	}
 
 	// Apply sort
-	if srt := getSort(q); len(srt) > 0 {
+	if srt := h.getSort(q); len(srt) > 0 {
 		s.SortBy(srt...)
 	}
 
@@ -194,7 +957,64 @@ func (h *Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 		}
 	}
 
-	// Perform query
+	// Only fetch metadata fields from the source if disabled
+	if h.SourceDisabled {
+		s.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(etagField, updatedField))
+	} else if fsc := h.projectedSource(q.Projection); fsc != nil {
+		s.FetchSourceContext(fsc)
+	}
+
+	// Apply field collapsing
+	if h.CollapseField != "" {
+		c := elastic.NewCollapseBuilder(h.getField(h.CollapseField, true))
+		if h.CollapseInnerHitsSize > 0 {
+			c.InnerHit(elastic.NewInnerHit().Name(innerHitsField).Size(h.CollapseInnerHitsSize))
+		}
+		s.Collapse(c)
+	}
+	return s, nil
+}
+
+// templatable returns true if the search of q with ctx can be performed with a
+// precompiled search template. Templates only hold the query, sort, pagination
+// and source filter, searches needing any other option are thus performed
+// without template so they return the same results.
+func (h *Handler) templatable(ctx context.Context, q *query.Query) bool {
+	if _, ok := postFilterFromContext(ctx); ok || aggregationsFromContext(ctx) != nil {
+		return false
+	}
+	if h.CollapseField != "" || h.ShardTimeout > 0 || len(q.Projection) > 0 {
+		return false
+	}
+	opts := GetESOptions(ctx)
+	return opts.QueryCache == nil && opts.MinScore == nil && h.searchRouting(ctx, q) == ""
+}
+
+// searchRouting returns the routing key of the search of q, from the ES
+// options of ctx, DefaultRouting or the parent id q is restricted to.
+func (h *Handler) searchRouting(ctx context.Context, q *query.Query) string {
+	if r := GetESOptions(ctx).Routing; r != "" {
+		return r
+	}
+	if h.DefaultRouting != "" {
+		return h.DefaultRouting
+	}
+	return h.queryRouting(q)
+}
+
+// searchTypes returns the types searched for q, as returned by TypeSelector if
+// set or the handler's type otherwise.
+func (h *Handler) searchTypes(q *query.Query) []string {
+	if h.TypeSelector != nil {
+		if types := h.TypeSelector(q); len(types) > 0 {
+			return types
+		}
+	}
+	return []string{h.typ}
+}
+
+// search performs the s search.
+func (h *Handler) search(ctx context.Context, s *elastic.SearchService) (*elastic.SearchResult, error) {
 	res, err := s.Do(ctx)
 	// Translate some generic errors
 	if err != nil {
@@ -203,39 +1023,81 @@ func (h *Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 		}
 		return nil, err
 	}
+	return res, nil
+}
 
-	// Fetch the result and return it as a resource.ItemList
+// buildItemList fetches the result of a search and returns it as a
+// resource.ItemList
+func buildItemList(res *elastic.SearchResult) (*resource.ItemList, error) {
 	list := &resource.ItemList{Total: 0, Items: []*resource.Item{}}
 	if res.Hits == nil || res.Hits.TotalHits == 0 {
 		return list, nil
 	}
 
 	list.Total = int(res.Hits.TotalHits)
-	list.Items = make([]*resource.Item, len(res.Hits.Hits))
-	for i, hit := range res.Hits.Hits {
-		d := map[string]interface{}{}
-		err := json.Unmarshal(*hit.Source, &d)
-		if err != nil {
-			return nil, fmt.Errorf("find unmarshaling error for item #%d: %v", i+1, err)
-		}
-		list.Items[i] = buildItem(hit.Id, d)
+	items, err := buildHitItems(res.Hits.Hits)
+	if err != nil {
+		return nil, err
 	}
+	list.Items = items
 
 	return list, nil
 }
 
+// buildHitItems builds the resource.Item of each search hit, including the
+// items of their collapsed inner hits if any.
+func buildHitItems(hits []*elastic.SearchHit) ([]*resource.Item, error) {
+	items := make([]*resource.Item, len(hits))
+	for i, hit := range hits {
+		d := map[string]interface{}{}
+		if hit.Source != nil {
+			if err := json.Unmarshal(*hit.Source, &d); err != nil {
+				return nil, fmt.Errorf("find unmarshaling error for item #%d: %v", i+1, err)
+			}
+		}
+		items[i] = buildItem(hit.Id, d)
+		if ih, found := hit.InnerHits[innerHitsField]; found && ih.Hits != nil {
+			inner, err := buildHitItems(ih.Hits.Hits)
+			if err != nil {
+				return nil, err
+			}
+			items[i].Payload[innerHitsField] = inner
+		}
+	}
+	return items, nil
+}
+
 // MultiGet implements the optional MultiGetter interface
 func (h *Handler) MultiGet(ctx context.Context, ids []interface{}) ([]*resource.Item, error) {
-	g := h.client.MultiGet()
-
-	// Add item ids to retrieve
+	strIDs := make([]string, 0, len(ids))
 	for _, v := range ids {
 		id, ok := v.(string)
 		if !ok {
 			return nil, fmt.Errorf("non string IDs are not supported with ElasticSearch (index=%s, type=%s, id=%#v)",
 				h.index, h.typ, v)
 		}
-		g.Add(elastic.NewMultiGetItem().Index(h.index).Type(h.typ).Id(id))
+		strIDs = append(strIDs, id)
+	}
+
+	// Without routing keys, custom routed documents must be searched on all
+	// shards
+	if h.RoutingField != "" || h.ParentIDField != "" {
+		return h.multiGetSearch(ctx, strIDs)
+	}
+
+	g := h.reader().MultiGet()
+	if p := h.preference(ctx); p != "" {
+		g.Preference(p)
+	}
+
+	// Add item ids to retrieve
+	fsc := h.fetchSource()
+	for _, id := range strIDs {
+		item := elastic.NewMultiGetItem().Index(h.index).Type(h.typ).Id(id)
+		if fsc != nil {
+			item.FetchSource(fsc)
+		}
+		g.Add(item)
 	}
 
 	res, err := g.Do(ctx)
@@ -247,14 +1109,8 @@ func (h *Handler) MultiGet(ctx context.Context, ids []interface{}) ([]*resource.
 		return nil, err
 	}
 
-	total := 0
+	items := make([]*resource.Item, 0, len(res.Docs))
 	for _, subRes := range res.Docs {
-		if subRes.Found {
-			total++
-		}
-	}
-	items := make([]*resource.Item, total)
-	for i, subRes := range res.Docs {
 		if !subRes.Found {
 			continue
 		}
@@ -262,7 +1118,135 @@ func (h *Handler) MultiGet(ctx context.Context, ids []interface{}) ([]*resource.
 		if err = json.Unmarshal(*subRes.Source, &d); err != nil {
 			return nil, fmt.Errorf("multi get unmarshaling error (index=%s, type=%s, id=%s): %v", h.index, h.typ, subRes.Id, err)
 		}
-		items[i] = buildItem(subRes.Id, d)
+		items = append(items, buildItem(subRes.Id, d))
 	}
-	return items, nil
+	return h.filterItems(ctx, items), nil
+}
+
+// multiGetSearch retrieves items by ids using a search so documents are found
+// whatever their routing key.
+func (h *Handler) multiGetSearch(ctx context.Context, ids []string) ([]*resource.Item, error) {
+	s := h.reader().Search().Index(h.index).Type(h.typ)
+	s.Query(elastic.NewIdsQuery(h.typ).Ids(ids...)).Size(len(ids))
+	if p := h.preference(ctx); p != "" {
+		s.Preference(p)
+	}
+	if fsc := h.fetchSource(); fsc != nil {
+		s.FetchSourceContext(fsc)
+	}
+	res, err := s.Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("multi get error (index=%s, type=%s, ids=%s): %v", h.index, h.typ, ids, err)
+		}
+		return nil, err
+	}
+	if res.Hits == nil {
+		return []*resource.Item{}, nil
+	}
+	items, err := buildHitItems(res.Hits.Hits)
+	if err != nil {
+		return nil, err
+	}
+	return h.filterItems(ctx, items), nil
+}
+
+// documentFilter returns the DocumentFilter query for ctx if any.
+func (h *Handler) documentFilter(ctx context.Context) *query.Query {
+	if h.DocumentFilter == nil {
+		return nil
+	}
+	if f := h.DocumentFilter(ctx); f != nil && len(f.Predicate) > 0 {
+		return f
+	}
+	return nil
+}
+
+// filterQuery returns q restricted to the items matching the DocumentFilter
+// query for ctx if any.
+func (h *Handler) filterQuery(ctx context.Context, q *query.Query) *query.Query {
+	f := h.documentFilter(ctx)
+	if f == nil {
+		return q
+	}
+	// The expressions of a predicate are and'ed
+	fq := *q
+	fq.Predicate = make(query.Predicate, 0, len(q.Predicate)+len(f.Predicate))
+	fq.Predicate = append(fq.Predicate, q.Predicate...)
+	fq.Predicate = append(fq.Predicate, f.Predicate...)
+	return &fq
+}
+
+// filterItems returns the items matching the DocumentFilter query for ctx if
+// any.
+func (h *Handler) filterItems(ctx context.Context, items []*resource.Item) []*resource.Item {
+	f := h.documentFilter(ctx)
+	if f == nil {
+		return items
+	}
+	filtered := make([]*resource.Item, 0, len(items))
+	for _, item := range items {
+		if f.Predicate.Match(item.Payload) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// preference returns the search preference to use for reads, the preference
+// of the ES options of ctx if any or Preference otherwise.
+func (h *Handler) preference(ctx context.Context) string {
+	if p := GetESOptions(ctx).Preference; p != "" {
+		return p
+	}
+	return h.Preference
+}
+
+// reader returns the client to use for read operations.
+func (h *Handler) reader() *elastic.Client {
+	if h.readClient != nil {
+		return h.readClient
+	}
+	return h.client
+}
+
+// itemIndex returns the index storing item, as returned by IndexSelector if
+// set or the handler's index otherwise.
+func (h *Handler) itemIndex(item *resource.Item) string {
+	if h.IndexSelector != nil {
+		if index := h.IndexSelector(item); index != "" {
+			return index
+		}
+	}
+	return h.index
+}
+
+// routing returns the routing key of item if ParentIDField or RoutingField is
+// set.
+func (h *Handler) routing(item *resource.Item) string {
+	field := h.RoutingField
+	if h.ParentIDField != "" {
+		field = h.ParentIDField
+	}
+	if field == "" {
+		return ""
+	}
+	if v, found := item.Payload[field]; found && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// queryRouting returns the parent id q is restricted to if ParentIDField is
+// set and the predicate of q has an equality on this field at its root.
+func (h *Handler) queryRouting(q *query.Query) string {
+	if h.ParentIDField == "" {
+		return ""
+	}
+	for _, exp := range q.Predicate {
+		if eq, ok := exp.(*query.Equal); ok && eq.Field == h.ParentIDField && eq.Value != nil {
+			return fmt.Sprint(eq.Value)
+		}
+	}
+	return ""
 }
@@ -1,8 +1,15 @@
 package es
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,6 +22,64 @@ import (
 var now = time.Now()
 var nowStr = now.Format(time.RFC3339Nano)
 
+// benchHandler is the handler used by Find benchmarks. It is only set when
+// benchmarks are run.
+var benchHandler *Handler
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if f := flag.Lookup("test.bench"); f == nil || f.Value.String() == "" || testing.Short() {
+		os.Exit(m.Run())
+	}
+	c, err := elastic.NewClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "benchmark setup error: %v\n", err)
+		os.Exit(1)
+	}
+	clean := cleanup(c, "benchfind")
+	if benchHandler, err = setupBenchFind(c, "benchfind", 10000); err != nil {
+		fmt.Fprintf(os.Stderr, "benchmark setup error: %v\n", err)
+		clean()
+		os.Exit(1)
+	}
+	code := m.Run()
+	clean()
+	os.Exit(code)
+}
+
+// setupBenchFind creates a handler on index with n documents.
+func setupBenchFind(c *elastic.Client, index string, n int) (*Handler, error) {
+	h := NewHandler(c, index, "test")
+	ctx := context.Background()
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	items := make([]*resource.Item, 0, 1000)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%d", i)
+		items = append(items, &resource.Item{
+			ID:      id,
+			ETag:    "etag" + id,
+			Updated: now,
+			Payload: map[string]interface{}{
+				"id":       id,
+				"name":     "name" + id,
+				"category": fmt.Sprintf("c%d", i%10),
+				"age":      i % 100,
+				"created":  start.Add(time.Duration(i) * time.Hour),
+			},
+		})
+		if len(items) == cap(items) || i == n-1 {
+			if err := h.Insert(ctx, items); err != nil {
+				return nil, err
+			}
+			items = items[:0]
+		}
+	}
+	if _, err := c.Refresh(index).Do(ctx); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
 // cleanup deletes an index immediately and on defer when call as:
 //
 //   defer cleanup(c, "index")()
@@ -63,7 +128,197 @@ func TestInsert(t *testing.T) {
 
 	// Inserting same item twice should return a conflict error
 	err = h.Insert(ctx, items)
-	assert.Equal(t, resource.ErrConflict, err)
+	assert.IsType(t, &BulkError{}, err)
+	assert.True(t, IsConflict(err))
+
+	// Mixed failures are reported per item
+	items = []*resource.Item{
+		items[0],
+		{ID: "2345", Payload: map[string]interface{}{"id": "2345", "foo": "bar"}},
+		{ID: "3456", Payload: map[string]interface{}{"id": "3456", "foo": map[string]interface{}{"bar": "baz"}}},
+	}
+	err = h.Insert(ctx, items)
+	if assert.IsType(t, &BulkError{}, err) {
+		be := err.(*BulkError)
+		if assert.Len(t, be.Errors, 2) {
+			assert.Equal(t, 0, be.Errors[0].Index)
+			assert.Equal(t, "1234", be.Errors[0].ID)
+			assert.Equal(t, resource.ErrConflict, be.Errors[0].Err)
+			assert.Equal(t, 2, be.Errors[1].Index)
+			assert.Equal(t, "3456", be.Errors[1].ID)
+			assert.NotEqual(t, resource.ErrConflict, be.Errors[1].Err)
+		}
+	}
+}
+
+// bulkServer is a fake ES bulk endpoint rejecting the whole request with a 429
+// status rejects times, then each item as many times as set in itemRejects. If
+// failAt is set, the failAt-th request fails with a 500 status.
+type bulkServer struct {
+	rejects     int
+	itemRejects map[string]int
+	failAt      int
+	// attempts lists the ids sent by each bulk request
+	attempts [][]string
+}
+
+func (s *bulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ids := []string{}
+	items := []map[string]interface{}{}
+	errs := false
+	sc := bufio.NewScanner(r.Body)
+	for i := 0; sc.Scan(); i++ {
+		if i%2 == 1 {
+			// Document line
+			continue
+		}
+		action := map[string]map[string]interface{}{}
+		if err := json.Unmarshal(sc.Bytes(), &action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for op, meta := range action {
+			id, _ := meta["_id"].(string)
+			ids = append(ids, id)
+			item := map[string]interface{}{"_id": id, "status": http.StatusCreated}
+			if s.itemRejects[id] > 0 {
+				s.itemRejects[id]--
+				item["status"] = http.StatusTooManyRequests
+				item["error"] = map[string]interface{}{"type": "es_rejected_execution_exception", "reason": "rejected"}
+				errs = true
+			}
+			items = append(items, map[string]interface{}{op: item})
+		}
+	}
+	s.attempts = append(s.attempts, ids)
+	if len(s.attempts) == s.failAt {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"type":"exception","reason":"failed"},"status":500}`))
+		return
+	}
+	if s.rejects > 0 {
+		s.rejects--
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"type":"es_rejected_execution_exception","reason":"rejected"},"status":429}`))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": errs, "items": items})
+}
+
+func TestDoBulkRetry(t *testing.T) {
+	reqs := []elastic.BulkableRequest{}
+	for _, id := range []string{"1", "2", "3"} {
+		reqs = append(reqs, elastic.NewBulkIndexRequest().Index("index").Type("type").Id(id).Doc(map[string]interface{}{}))
+	}
+	cases := []struct {
+		name        string
+		maxRetries  int
+		rejects     int
+		itemRejects map[string]int
+		failAt      int
+		attempts    [][]string
+		backoffs    []int
+		rejected    []string
+		err         int
+	}{
+		{"no rejection", 2, 0, nil, 0, [][]string{{"1", "2", "3"}}, []int{}, []string{}, 0},
+		{"rejected items", 2, 0, map[string]int{"2": 2, "3": 1}, 0,
+			[][]string{{"1", "2", "3"}, {"2", "3"}, {"2"}}, []int{0, 1}, []string{}, 0},
+		{"rejected request", 2, 1, nil, 0,
+			[][]string{{"1", "2", "3"}, {"1", "2", "3"}}, []int{0}, []string{}, 0},
+		{"too many item rejections", 1, 0, map[string]int{"2": 2}, 0,
+			[][]string{{"1", "2", "3"}, {"2"}}, []int{0}, []string{"2"}, 0},
+		{"too many request rejections", 1, 2, nil, 0,
+			[][]string{{"1", "2", "3"}, {"1", "2", "3"}}, []int{0}, nil, http.StatusTooManyRequests},
+		{"no retry", 0, 0, map[string]int{"1": 1}, 0,
+			[][]string{{"1", "2", "3"}}, []int{}, []string{"1"}, 0},
+		{"failed request", 2, 0, nil, 1,
+			[][]string{{"1", "2", "3"}}, []int{}, nil, http.StatusInternalServerError},
+		{"failed retry", 2, 0, map[string]int{"2": 1}, 2,
+			[][]string{{"1", "2", "3"}, {"2"}}, []int{0}, []string{"2"}, http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		s := &bulkServer{rejects: tc.rejects, itemRejects: tc.itemRejects, failAt: tc.failAt}
+		ts := httptest.NewServer(s)
+		c, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+		if !assert.NoError(t, err, tc.name) {
+			ts.Close()
+			continue
+		}
+		h := NewHandler(c, "index", "type")
+		h.MaxRetries = tc.maxRetries
+		backoffs := []int{}
+		h.RetryBackoff = func(attempt int) time.Duration {
+			backoffs = append(backoffs, attempt)
+			return time.Millisecond
+		}
+		res, err := h.doBulk(context.Background(), reqs)
+		ts.Close()
+		assert.Equal(t, tc.attempts, s.attempts, tc.name)
+		assert.Equal(t, tc.backoffs, backoffs, tc.name)
+		if tc.err != 0 {
+			if e, ok := err.(*elastic.Error); assert.True(t, ok, tc.name) {
+				assert.Equal(t, tc.err, e.Status, tc.name)
+			}
+			// The response of the previous attempts is returned with the error
+			if tc.rejected == nil {
+				assert.Nil(t, res, tc.name)
+				continue
+			}
+		} else if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		if !assert.Len(t, res.Items, 3, tc.name) {
+			continue
+		}
+		rejected := []string{}
+		for _, item := range res.Items {
+			for _, r := range item {
+				if r.Status == http.StatusTooManyRequests {
+					rejected = append(rejected, r.Id)
+				}
+			}
+		}
+		assert.Equal(t, tc.rejected, rejected, tc.name)
+		assert.Equal(t, len(tc.rejected) > 0, res.Errors, tc.name)
+	}
+}
+
+func TestBulkUpsert(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testbulkupsert")()
+	h := NewHandler(c, "testbulkupsert", "test")
+	ctx := context.TODO()
+	err = h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "etag1", Payload: map[string]interface{}{"id": "1", "foo": "bar"}},
+	})
+	assert.NoError(t, err)
+
+	items := []*resource.Item{
+		{ID: "1", ETag: "etag2", Payload: map[string]interface{}{"id": "1", "foo": "baz"}},
+		{ID: "2", ETag: "etag3", Payload: map[string]interface{}{"id": "2", "foo": "qux"}},
+	}
+	// Upserting is idempotent
+	assert.NoError(t, h.BulkUpsert(ctx, items))
+	assert.NoError(t, h.BulkUpsert(ctx, items))
+
+	for _, item := range items {
+		res, err := c.Get().Index("testbulkupsert").Type("test").Id(item.ID.(string)).Do(ctx)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		d := map[string]interface{}{}
+		if assert.NoError(t, json.Unmarshal(*res.Source, &d)) {
+			assert.Equal(t, item.Payload["foo"], d["foo"])
+			assert.Equal(t, item.ETag, d["_etag"])
+		}
+	}
 }
 
 func TestUpdate(t *testing.T) {
@@ -148,17 +403,40 @@ func TestDelete(t *testing.T) {
 	assert.Equal(t, resource.ErrConflict, err)
 }
 
+func TestSafeDelete(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testsafedelete")()
+	h := NewHandler(c, "testsafedelete", "test")
+	h.Refresh = "true"
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1"}}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, []*resource.Item{item}))
+
+	// ETag is still checked
+	assert.Equal(t, resource.ErrConflict, h.SafeDelete(ctx, &resource.Item{ID: "1", ETag: "b"}))
+	assert.NoError(t, h.SafeDelete(ctx, item))
+	// Deleting a missing item is a no-op
+	assert.NoError(t, h.SafeDelete(ctx, item))
+	assert.Equal(t, resource.ErrNotFound, h.Delete(ctx, item))
+}
+
 func TestClear(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
 	}
-	t.Skip("clear doesn't work yet")
 	c, err := elastic.NewClient()
 	if !assert.NoError(t, err) {
 		return
 	}
 	defer cleanup(c, "testclear")()
 	h := NewHandler(c, "testclear", "test")
+	h.Refresh = "true"
 	items := []*resource.Item{
 		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
 		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b"}},
@@ -177,12 +455,98 @@ func TestClear(t *testing.T) {
 		assert.Equal(t, 2, deleted)
 	}
 
+	// Deletions are immediately visible with Refresh set to true
+	q, err = query.New("", "", "", nil)
+	if assert.NoError(t, err) {
+		l, err := h.Find(ctx, q)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 2, l.Total)
+		}
+	}
+
 	q, err = query.New("", `{id:"2"}`, "", nil)
 	if assert.NoError(t, err) {
 		deleted, err := h.Clear(ctx, q)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, deleted)
 	}
+
+	// Clear respects context deadline
+	q, err = query.New("", "", "", nil)
+	if assert.NoError(t, err) {
+		dctx, cancel := context.WithTimeout(ctx, -1*time.Second)
+		defer cancel()
+		_, err := h.Clear(dctx, q)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	}
+
+	// Empty predicate clears all
+	q, err = query.New("", "", "", nil)
+	if assert.NoError(t, err) {
+		assert.NoError(t, h.Insert(ctx, items[1:]))
+		deleted, err := h.Clear(ctx, q)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, deleted)
+		l, err := h.Find(ctx, q)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 0, l.Total)
+		}
+	}
+}
+
+func TestClearWithConflicts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testclearconflicts")()
+	// Disable periodic refreshes so updates are only visible to searches
+	// when requested
+	h := NewHandler(c, "testclearconflicts", "test", WithIndexSettings(map[string]interface{}{
+		"refresh_interval": "-1",
+	}))
+	h.Refresh = "true"
+	h.ClearConflicts = "proceed"
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+		{ID: "3", ETag: "c", Payload: map[string]interface{}{"id": "3", "name": "c"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	deleted, conflicts, err := h.ClearWithConflicts(ctx, q)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+	assert.Equal(t, 0, conflicts)
+
+	assert.NoError(t, h.Insert(ctx, items))
+	// Update item 1 without refresh: delete by query sees its previous
+	// version, so deleting it is a version conflict
+	h.Refresh = "false"
+	updated := &resource.Item{ID: "1", ETag: "d", Payload: map[string]interface{}{"id": "1", "name": "d"}}
+	assert.NoError(t, h.Update(ctx, updated, items[0]))
+	h.Refresh = "true"
+	deleted, conflicts, err = h.ClearWithConflicts(ctx, q)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.Equal(t, 1, conflicts)
+
+	// Only the conflicting item remains
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "1", l.Items[0].ID)
+		assert.Equal(t, "d", l.Items[0].ETag)
+	}
+
 }
 
 func TestFind(t *testing.T) {
@@ -352,3 +716,950 @@ func TestFind(t *testing.T) {
 		}
 	}
 }
+
+func TestInsertWithVersion(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testinsertwithversion")()
+	h := NewHandler(c, "testinsertwithversion", "test")
+	h.Refresh = "true"
+	ctx := context.TODO()
+
+	err = h.InsertWithVersion(ctx, []*ItemWithVersion{
+		{Item: &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a2"}}, Version: 2},
+		{Item: &resource.Item{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b1"}}, Version: 1},
+	})
+	assert.NoError(t, err)
+
+	// Replaying an older version of item 1 is rejected
+	err = h.InsertWithVersion(ctx, []*ItemWithVersion{
+		{Item: &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a1"}}, Version: 1},
+	})
+	assert.True(t, IsConflict(err))
+
+	// A newer version of item 2 overwrites it
+	err = h.InsertWithVersion(ctx, []*ItemWithVersion{
+		{Item: &resource.Item{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b2"}}, Version: 2},
+	})
+	assert.NoError(t, err)
+
+	l, err := h.MultiGet(ctx, []interface{}{"1", "2"})
+	if assert.NoError(t, err) && assert.Len(t, l, 2) {
+		assert.Equal(t, "a2", l[0].Payload["name"])
+		assert.Equal(t, "b2", l[1].Payload["name"])
+	}
+}
+
+func TestIndexSelector(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testindexselector-a")()
+	defer cleanup(c, "testindexselector-b")()
+	h := NewHandler(c, "testindexselector-*", "test")
+	h.Refresh = "true"
+	h.IndexSelector = func(item *resource.Item) string {
+		return "testindexselector-" + item.Payload["day"].(string)
+	}
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "day": "a"}},
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "day": "b"}},
+		{ID: "3", ETag: "a", Payload: map[string]interface{}{"id": "3", "day": "a"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	res, err := c.Count("testindexselector-a").Do(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), res)
+	}
+	res, err = c.Count("testindexselector-b").Do(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), res)
+	}
+
+	// Failures are reported at the position of the item in the insert
+	err = h.Insert(ctx, []*resource.Item{
+		{ID: "4", ETag: "a", Payload: map[string]interface{}{"id": "4", "day": "a"}},
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "day": "b"}},
+	})
+	assert.True(t, IsConflict(err))
+	if be, ok := err.(*BulkError); assert.True(t, ok) {
+		assert.Equal(t, []BulkItemError{{Index: 1, ID: "2", Err: resource.ErrConflict}}, be.Errors)
+	}
+
+	// Update and delete go to the selected index
+	item := &resource.Item{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "day": "b", "name": "b"}}
+	assert.NoError(t, h.Update(ctx, item, items[1]))
+	assert.NoError(t, h.Delete(ctx, item))
+	res, err = c.Count("testindexselector-b").Do(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(0), res)
+	}
+}
+
+func TestFindCollapse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindcollapse")()
+	h := NewHandler(c, "testfindcollapse", "test")
+	h.Refresh = "true"
+	h.CollapseField = "group"
+	h.CollapseInnerHitsSize = 5
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "group": "a", "name": "a1"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "group": "a", "name": "a2"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "group": "b", "name": "b1"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", "", "name", query.Page(1, 10, 0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 2) {
+		assert.Equal(t, "1", l.Items[0].ID)
+		if inner, ok := l.Items[0].Payload["_inner_hits"].([]*resource.Item); assert.True(t, ok) {
+			assert.Len(t, inner, 2)
+		}
+		assert.Equal(t, "3", l.Items[1].ID)
+		if inner, ok := l.Items[1].Payload["_inner_hits"].([]*resource.Item); assert.True(t, ok) {
+			assert.Len(t, inner, 1)
+		}
+	}
+}
+
+func TestFindSourceDisabled(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindsourcedisabled")()
+	h := NewHandler(c, "testfindsourcedisabled", "test")
+	h.Refresh = "true"
+	h.SourceDisabled = true
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{name:"b"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "2", l.Items[0].ID)
+		assert.Equal(t, "b", l.Items[0].ETag)
+		assert.Equal(t, map[string]interface{}{"id": "2"}, l.Items[0].Payload)
+	}
+}
+
+func TestSourceFilter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testsourcefilter")()
+	h := NewHandler(c, "testsourcefilter", "test")
+	h.Refresh = "true"
+	h.SourceExcludes = []string{"secret"}
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a", "secret": "s"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "a", l.Items[0].ETag)
+		assert.Equal(t, map[string]interface{}{"id": "1", "name": "a"}, l.Items[0].Payload)
+	}
+	g, err := h.MultiGet(ctx, []interface{}{"1"})
+	if assert.NoError(t, err) && assert.Len(t, g, 1) {
+		assert.Equal(t, "a", g[0].ETag)
+		assert.Equal(t, map[string]interface{}{"id": "1", "name": "a"}, g[0].Payload)
+	}
+
+	h.SourceExcludes = nil
+	h.SourceIncludes = []string{"secret"}
+	g, err = h.MultiGet(ctx, []interface{}{"1"})
+	if assert.NoError(t, err) && assert.Len(t, g, 1) {
+		assert.Equal(t, "a", g[0].ETag)
+		assert.Equal(t, map[string]interface{}{"id": "1", "secret": "s"}, g[0].Payload)
+	}
+}
+
+func TestFindProjection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindprojection")()
+	h := NewHandler(c, "testfindprojection", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a", "age": 1, "meta": map[string]interface{}{"title": "t", "body": "b"}}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("id,name,meta{title}", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "a", l.Items[0].ETag)
+		assert.Equal(t, map[string]interface{}{"id": "1", "name": "a", "meta": map[string]interface{}{"title": "t", "body": "b"}}, l.Items[0].Payload)
+	}
+
+	q, err = query.New("*", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err = h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Len(t, l.Items[0].Payload, 4)
+	}
+}
+
+func TestFindNested(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindnested")()
+	ctx := context.TODO()
+	_, err = c.CreateIndex("testfindnested").BodyString(`{"mappings":{"test":{"properties":{"authors":{"type":"nested"}}}}}`).Do(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(c, "testfindnested", "test")
+	h.Refresh = "true"
+	h.NestedPaths = []string{"authors"}
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "authors": []interface{}{
+			map[string]interface{}{"first": "John", "last": "Smith"},
+			map[string]interface{}{"first": "Alice", "last": "White"},
+		}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "authors": []interface{}{
+			map[string]interface{}{"first": "Alice", "last": "Smith"},
+		}}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	// Nested documents are only reachable through nested queries
+	q, err := query.New("", `{"authors.first":"Alice"}`, "", nil)
+	if assert.NoError(t, err) {
+		l, err := h.Find(ctx, q)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 2, l.Total)
+		}
+	}
+
+	q, err = query.New("", `{"authors.first":"John"}`, "", nil)
+	if assert.NoError(t, err) {
+		l, err := h.Find(ctx, q)
+		if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+			assert.Equal(t, "1", l.Items[0].ID)
+		}
+	}
+}
+
+func benchmarkFind(b *testing.B, predicate string) {
+	if benchHandler == nil {
+		b.Skip("skipping benchmark in short mode.")
+	}
+	q, err := query.New("", predicate, "", query.Page(1, 20, 0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := benchHandler.Find(ctx, q); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindMatchAll(b *testing.B) {
+	benchmarkFind(b, "")
+}
+
+func BenchmarkFindTerm(b *testing.B) {
+	benchmarkFind(b, `{name:"name42"}`)
+}
+
+func BenchmarkFindAnd10(b *testing.B) {
+	benchmarkFind(b, `{$and:[{category:{$ne:"c0"}},{category:{$ne:"c1"}},{category:{$ne:"c2"}},`+
+		`{category:{$ne:"c3"}},{category:{$ne:"c4"}},{category:{$ne:"c5"}},{category:{$ne:"c6"}},`+
+		`{category:{$ne:"c7"}},{category:{$ne:"c8"}},{age:{$gte:0}}]}`)
+}
+
+func BenchmarkFindNestedOrAnd(b *testing.B) {
+	benchmarkFind(b, `{$or:[{$and:[{category:"c1"},{age:{$gt:50}}]},{$and:[{category:"c2"},{age:{$lt:10}}]}]}`)
+}
+
+func BenchmarkFindDateRange(b *testing.B) {
+	// 2017-03-01T00:00:00Z in milliseconds
+	benchmarkFind(b, `{created:{$gte:1488326400000}}`)
+}
+
+func TestRouting(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testrouting")()
+	h := NewHandler(c, "testrouting", "test", WithShards(4))
+	h.Refresh = "true"
+	h.RoutingField = "tenant"
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "tenant": "a"}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "tenant": "b"}},
+		{ID: "3", ETag: "c", Payload: map[string]interface{}{"id": "3", "tenant": "a"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	res, err := c.Get().Index("testrouting").Type("test").Id("1").Routing("a").Do(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a", res.Routing)
+	}
+
+	l, err := h.MultiGet(ctx, []interface{}{"1", "2", "4"})
+	if assert.NoError(t, err) {
+		assert.Len(t, l, 2)
+	}
+
+	ha := NewHandler(c, "testrouting", "test")
+	ha.DefaultRouting = "a"
+	q, err := query.New("", `{tenant:"a"}`, "", nil)
+	if assert.NoError(t, err) {
+		l, err := ha.Find(ctx, q)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 2, l.Total)
+		}
+	}
+
+	updated := &resource.Item{ID: "1", ETag: "d", Payload: map[string]interface{}{"id": "1", "tenant": "a", "foo": "bar"}}
+	assert.NoError(t, h.Update(ctx, updated, items[0]))
+	assert.NoError(t, h.Delete(ctx, updated))
+}
+
+func TestParentIDRouting(t *testing.T) {
+	h := &Handler{ParentIDField: "post_id", RoutingField: "tenant"}
+	assert.Equal(t, "p1", h.routing(&resource.Item{Payload: map[string]interface{}{"post_id": "p1", "tenant": "a"}}))
+	assert.Equal(t, "", h.routing(&resource.Item{Payload: map[string]interface{}{"tenant": "a"}}))
+	q, err := query.New("", `{post_id:"p1",name:"a"}`, "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "p1", h.queryRouting(q))
+	}
+	q, err = query.New("", `{$or:[{post_id:"p1"},{post_id:"p2"}]}`, "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", h.queryRouting(q))
+	}
+}
+
+func TestParentID(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testparentid")()
+	h := NewHandler(c, "testparentid", "test", WithShards(4))
+	h.Refresh = "true"
+	h.ParentIDField = "post_id"
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	items := []*resource.Item{
+		{ID: "p1", ETag: "a", Payload: map[string]interface{}{"id": "p1"}},
+		{ID: "p2", ETag: "b", Payload: map[string]interface{}{"id": "p2"}},
+		{ID: "c1", ETag: "c", Payload: map[string]interface{}{"id": "c1", "post_id": "p1"}},
+		{ID: "c2", ETag: "d", Payload: map[string]interface{}{"id": "c2", "post_id": "p1"}},
+		{ID: "c3", ETag: "e", Payload: map[string]interface{}{"id": "c3", "post_id": "p2"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	// Children are stored on the shard of their parent
+	res, err := c.Get().Index("testparentid").Type("test").Id("c1").Routing("p1").Do(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "p1", res.Routing)
+	}
+
+	l, err := h.MultiGet(ctx, []interface{}{"p1", "c1", "c3"})
+	if assert.NoError(t, err) {
+		assert.Len(t, l, 3)
+	}
+
+	q, err := query.New("", `{post_id:"p1"}`, "", nil)
+	if assert.NoError(t, err) {
+		l, err := h.Find(ctx, q)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 2, l.Total)
+		}
+	}
+
+	updated := &resource.Item{ID: "c1", ETag: "f", Payload: map[string]interface{}{"id": "c1", "post_id": "p1", "foo": "bar"}}
+	assert.NoError(t, h.Update(ctx, updated, items[2]))
+	assert.NoError(t, h.Delete(ctx, updated))
+}
+
+func TestWithReadClient(t *testing.T) {
+	w, r := &elastic.Client{}, &elastic.Client{}
+	h := NewHandler(w, "index", "type")
+	assert.True(t, h.reader() == w)
+	h = NewHandler(w, "index", "type", WithReadClient(r))
+	assert.True(t, h.reader() == r)
+	assert.True(t, h.client == w)
+}
+
+func TestWithReadClientRequests(t *testing.T) {
+	// The write cluster fails all requests while the read one only answers
+	// searches and multi gets
+	writes := []string{}
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writes = append(writes, r.URL.Path)
+		http.Error(w, `{"error":{"type":"exception","reason":"write cluster"},"status":500}`, http.StatusInternalServerError)
+	}))
+	defer ws.Close()
+	reads := []string{}
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads = append(reads, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_search"):
+			w.Write([]byte(`{"took":1,"hits":{"total":0,"hits":[]}}`))
+		case strings.HasSuffix(r.URL.Path, "/_mget"):
+			w.Write([]byte(`{"docs":[{"_index":"index","_type":"type","_id":"1","found":false}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer rs.Close()
+	wc, err := elastic.NewClient(elastic.SetURL(ws.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if !assert.NoError(t, err) {
+		return
+	}
+	rc, err := elastic.NewClient(elastic.SetURL(rs.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(wc, "index", "type", WithReadClient(rc))
+	ctx := context.Background()
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, l.Total)
+	}
+	items, err := h.MultiGet(ctx, []interface{}{"1"})
+	if assert.NoError(t, err) {
+		assert.Empty(t, items)
+	}
+	assert.Equal(t, []string{"/index/type/_search", "/_mget"}, reads)
+	assert.Empty(t, writes)
+}
+
+func TestFindWithAggregations(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindaggregations")()
+	h := NewHandler(c, "testfindaggregations", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a", "age": 1}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "a", "age": 2}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "b", "age": 3}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	ctx = WithAggregations(ctx, map[string]elastic.Aggregation{
+		"names":   elastic.NewTermsAggregation().Field("name.keyword"),
+		"max_age": elastic.NewMaxAggregation().Field("age"),
+	})
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, l.Total)
+	}
+	aggs := AggregationsFromContext(ctx)
+	if names, found := aggs.Terms("names"); assert.True(t, found) && assert.Len(t, names.Buckets, 2) {
+		assert.Equal(t, "a", names.Buckets[0].Key)
+		assert.Equal(t, int64(2), names.Buckets[0].DocCount)
+	}
+	if max, found := aggs.Max("max_age"); assert.True(t, found) && assert.NotNil(t, max.Value) {
+		assert.Equal(t, float64(3), *max.Value)
+	}
+}
+
+func TestRefreshWaitFor(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testrefreshwaitfor")()
+	h := NewHandler(c, "testrefreshwaitfor", "test")
+	h.Refresh = RefreshWaitFor
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	// Inserted items are visible once Insert returned
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, l.Total)
+	}
+
+	// Clear falls back to a forced refresh
+	deleted, err := h.Clear(ctx, q)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	l, err = h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, l.Total)
+	}
+}
+
+func TestScriptUpdate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testscriptupdate")()
+	h := NewHandler(c, "testscriptupdate", "test")
+	h.Refresh = "true"
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "counter": 1}}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, []*resource.Item{item}))
+
+	script := "ctx._source.counter += params.n"
+	params := map[string]interface{}{"n": 2}
+	assert.Equal(t, resource.ErrConflict, h.ScriptUpdate(ctx, "1", "b", script, params))
+	assert.Equal(t, resource.ErrNotFound, h.ScriptUpdate(ctx, "2", "a", script, params))
+	assert.NoError(t, h.ScriptUpdate(ctx, "1", "a", script, params))
+	assert.Equal(t, map[string]interface{}{"n": 2}, params)
+
+	l, err := h.MultiGet(ctx, []interface{}{"1"})
+	if assert.NoError(t, err) && assert.Len(t, l, 1) {
+		assert.Equal(t, float64(3), l[0].Payload["counter"])
+		assert.NotEqual(t, "a", l[0].ETag)
+		assert.True(t, l[0].Updated.After(item.Updated))
+	}
+}
+
+func TestSetGeneratedIDs(t *testing.T) {
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1"}},
+		{ID: "", Payload: map[string]interface{}{}},
+		{Payload: map[string]interface{}{}},
+	}
+	res := &elastic.BulkResponse{Items: []map[string]*elastic.BulkResponseItem{
+		{"index": {Id: "a"}},
+		{"index": {Error: &elastic.ErrorDetails{Type: "mapper_parsing_exception"}}},
+	}}
+	// Bulk response items are the items at positions 1 and 2
+	setGeneratedIDs(res, items, []int{1, 2})
+	assert.Equal(t, "1", items[0].ID)
+	assert.Equal(t, "a", items[1].ID)
+	assert.Equal(t, map[string]interface{}{"id": "a"}, items[1].Payload)
+	assert.Nil(t, items[2].ID)
+}
+
+func TestInsertAutoGenerateID(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testautogenerateid")()
+	h := NewHandler(c, "testautogenerateid", "test")
+	h.Refresh = "true"
+	h.AutoGenerateID = true
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{Payload: map[string]interface{}{"name": "b"}},
+		{ID: "", Payload: map[string]interface{}{"name": "c"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+	assert.Equal(t, "1", items[0].ID)
+	ids := []interface{}{}
+	for _, item := range items {
+		if assert.IsType(t, "", item.ID) {
+			assert.NotEmpty(t, item.ID)
+			assert.Equal(t, item.ID, item.Payload["id"])
+			ids = append(ids, item.ID)
+		}
+	}
+	l, err := h.MultiGet(ctx, ids)
+	if assert.NoError(t, err) {
+		assert.Len(t, l, 3)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testtouch")()
+	h := NewHandler(c, "testtouch", "test")
+	h.Refresh = "true"
+	item := &resource.Item{ID: "1", ETag: "a", Updated: time.Now().Add(-time.Hour), Payload: map[string]interface{}{"id": "1", "name": "a"}}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, []*resource.Item{item}))
+
+	assert.Equal(t, resource.ErrConflict, h.Touch(ctx, "1", "b"))
+	assert.NoError(t, h.Touch(ctx, "1", "a"))
+
+	l, err := h.MultiGet(ctx, []interface{}{"1"})
+	if assert.NoError(t, err) && assert.Len(t, l, 1) {
+		assert.Equal(t, "a", l[0].ETag)
+		assert.Equal(t, item.Payload, l[0].Payload)
+		assert.True(t, l[0].Updated.After(item.Updated.Add(time.Minute)))
+	}
+}
+
+func TestSearchTypes(t *testing.T) {
+	h := &Handler{typ: "test"}
+	q := &query.Query{}
+	assert.Equal(t, []string{"test"}, h.searchTypes(q))
+	h.TypeSelector = func(q *query.Query) []string {
+		if len(q.Predicate) == 0 {
+			return nil
+		}
+		return []string{"a", "b"}
+	}
+	assert.Equal(t, []string{"test"}, h.searchTypes(q))
+	q.Predicate = query.Predicate{&query.Equal{Field: "status", Value: "draft"}}
+	assert.Equal(t, []string{"a", "b"}, h.searchTypes(q))
+}
+
+func TestTypeSelector(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testtypeselector")()
+	published := NewHandler(c, "testtypeselector", "published")
+	published.Refresh = "true"
+	draft := NewHandler(c, "testtypeselector", "draft")
+	draft.Refresh = "true"
+	ctx := context.TODO()
+	assert.NoError(t, published.Insert(ctx, []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "status": "published"}},
+	}))
+	assert.NoError(t, draft.Insert(ctx, []*resource.Item{
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "status": "draft"}},
+	}))
+
+	published.TypeSelector = func(q *query.Query) []string {
+		for _, exp := range q.Predicate {
+			if eq, ok := exp.(*query.Equal); ok && eq.Field == "status" && eq.Value == "draft" {
+				return []string{"draft"}
+			}
+		}
+		return nil
+	}
+	q, err := query.New("", `{status:"draft"}`, "", nil)
+	if assert.NoError(t, err) {
+		l, err := published.Find(ctx, q)
+		if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+			assert.Equal(t, "2", l.Items[0].ID)
+		}
+	}
+	q2, err := query.New("", "", "", nil)
+	if assert.NoError(t, err) {
+		l, err := published.Find(ctx, q2)
+		if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+			assert.Equal(t, "1", l.Items[0].ID)
+		}
+	}
+
+	// MultiFind selects the types the same way
+	l, err := published.MultiFind(ctx, []*query.Query{q, q2})
+	if assert.NoError(t, err) && assert.Len(t, l, 2) {
+		if assert.Len(t, l[0].Items, 1) {
+			assert.Equal(t, "2", l[0].Items[0].ID)
+		}
+		if assert.Len(t, l[1].Items, 1) {
+			assert.Equal(t, "1", l[1].Items[0].ID)
+		}
+	}
+}
+
+func TestInsertIfNotExists(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testinsertifnotexists")()
+	h := NewHandler(c, "testinsertifnotexists", "test")
+	h.Refresh = "true"
+	ctx := context.TODO()
+	unique := []string{"tenant", "email"}
+
+	created, err := h.InsertIfNotExists(ctx, &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "tenant": "a", "email": "foo@example.com"}}, unique)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	created, err = h.InsertIfNotExists(ctx, &resource.Item{ID: "2", Payload: map[string]interface{}{"id": "2", "tenant": "a", "email": "foo@example.com"}}, unique)
+	assert.NoError(t, err)
+	assert.False(t, created)
+	created, err = h.InsertIfNotExists(ctx, &resource.Item{ID: "3", Payload: map[string]interface{}{"id": "3", "tenant": "b", "email": "foo@example.com"}}, unique)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	_, err = h.InsertIfNotExists(ctx, &resource.Item{ID: "4", Payload: map[string]interface{}{"id": "4", "tenant": "b"}}, unique)
+	assert.Error(t, err)
+
+	l, err := h.MultiGet(ctx, []interface{}{"1", "2", "3", "4"})
+	if assert.NoError(t, err) {
+		assert.Len(t, l, 2)
+	}
+}
+
+type tenantCtxKey struct{}
+
+// tenantFilter is a DocumentFilter restricting items to the tenant of ctx.
+func tenantFilter(ctx context.Context) *query.Query {
+	tenant, ok := ctx.Value(tenantCtxKey{}).(string)
+	if !ok {
+		return nil
+	}
+	return &query.Query{Predicate: query.Predicate{&query.Equal{Field: "tenant", Value: tenant}}}
+}
+
+func TestFilterQuery(t *testing.T) {
+	h := &Handler{}
+	ctx := context.WithValue(context.Background(), tenantCtxKey{}, "a")
+	q := &query.Query{Predicate: query.Predicate{&query.Equal{Field: "name", Value: "foo"}}}
+	assert.Equal(t, q, h.filterQuery(ctx, q))
+	h.DocumentFilter = tenantFilter
+	assert.Equal(t, q, h.filterQuery(context.Background(), q))
+	assert.Equal(t, &query.Query{Predicate: query.Predicate{
+		&query.Equal{Field: "name", Value: "foo"},
+		&query.Equal{Field: "tenant", Value: "a"},
+	}}, h.filterQuery(ctx, q))
+	// The original query is left untouched
+	assert.Len(t, q.Predicate, 1)
+
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"tenant": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"tenant": "b"}},
+	}
+	assert.Equal(t, items[:1], h.filterItems(ctx, items))
+	assert.Equal(t, items, h.filterItems(context.Background(), items))
+}
+
+func TestDocumentFilter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testdocumentfilter")()
+	h := NewHandler(c, "testdocumentfilter", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tenant": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "tenant": "b"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "tenant": "a"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	h.DocumentFilter = tenantFilter
+	h.ValidateDocumentFilter = true
+	actx := context.WithValue(ctx, tenantCtxKey{}, "a")
+	err = h.Insert(actx, []*resource.Item{{ID: "4", Payload: map[string]interface{}{"id": "4", "tenant": "b"}}})
+	assert.Equal(t, resource.ErrForbidden, err)
+
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(actx, q)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, l.Total)
+	}
+	ml, err := h.MultiGet(actx, []interface{}{"1", "2", "3"})
+	if assert.NoError(t, err) {
+		assert.Len(t, ml, 2)
+	}
+	deleted, err := h.Clear(actx, q)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	// Without tenant, nothing is filtered
+	l, err = h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "2", l.Items[0].ID)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testdryrun")()
+	h := NewHandler(c, "testdryrun", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	dctx := WithESOptions(ctx, ESRequestOptions{DryRun: true})
+	assert.NoError(t, h.Insert(dctx, []*resource.Item{{ID: "3", Payload: map[string]interface{}{"id": "3"}}}))
+	updated := &resource.Item{ID: "1", ETag: "c", Payload: map[string]interface{}{"id": "1", "name": "c"}}
+	assert.NoError(t, h.Update(dctx, updated, items[0]))
+	assert.Equal(t, resource.ErrConflict, h.Update(dctx, updated, updated))
+	assert.NoError(t, h.Delete(dctx, items[1]))
+	q, err := query.New("", `{name:"a"}`, "", nil)
+	if assert.NoError(t, err) {
+		deleted, err := h.Clear(dctx, q)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+	}
+
+	// Nothing has been written
+	l, err := h.MultiGet(ctx, []interface{}{"1", "2", "3"})
+	if assert.NoError(t, err) && assert.Len(t, l, 2) {
+		for _, item := range l {
+			assert.NotEqual(t, "c", item.Payload["name"])
+		}
+	}
+}
+
+func TestFindRegex(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindregex")()
+	h := NewHandler(c, "testfindregex", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "foo"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "foobar"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "barfoo"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "name": "bar42"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	cases := []struct {
+		regex string
+		ids   []string
+	}{
+		{`foo`, []string{"1", "2", "3"}},
+		{`^foo`, []string{"1", "2"}},
+		{`foo$`, []string{"1", "3"}},
+		{`^foo$`, []string{"1"}},
+		{`^bar[0-9]{2}$`, []string{"4"}},
+		{`^(foo|bar)+$`, []string{"1", "2", "3"}},
+	}
+	for _, tc := range cases {
+		q, err := query.New("", `{name:{$regex:"`+tc.regex+`"}}`, "", nil)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		l, err := h.Find(ctx, q)
+		if assert.NoError(t, err, tc.regex) {
+			ids := []string{}
+			for _, item := range l.Items {
+				ids = append(ids, item.ID.(string))
+			}
+			assert.ElementsMatch(t, tc.ids, ids, tc.regex)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package es
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/rest-layer/resource"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// ErrTooManyRequests is returned when ES rejects a request because it is
+// overloaded (HTTP 429).
+var ErrTooManyRequests = errors.New("Too Many Requests")
+
+// isTooManyRequests returns true if err is an ES 429 error.
+func isTooManyRequests(err error) bool {
+	if e, ok := err.(*elastic.Error); ok {
+		return e.Status == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// BulkItemError describes the failure of a single item of a bulk operation.
+type BulkItemError struct {
+	// Index is the position of the item in the bulk operation.
+	Index int
+	// ID is the id of the item.
+	ID string
+	// Err is the error returned by ES for the item. Version conflicts are
+	// reported as resource.ErrConflict.
+	Err error
+}
+
+// BulkError is returned by bulk operations when some items failed. As bulk
+// operations are not atomic with ES, items not listed in Errors have been
+// successfully stored. Use IsConflict to check if all failed items are version
+// conflicts.
+type BulkError struct {
+	Errors []BulkItemError
+}
+
+// Error implements the error interface.
+func (e *BulkError) Error() string {
+	if len(e.Errors) == 0 {
+		return "bulk error"
+	}
+	f := e.Errors[0]
+	return fmt.Sprintf("bulk error on %d item(s), first on item #%d (id=%s): %v", len(e.Errors), f.Index+1, f.ID, f.Err)
+}
+
+// AllConflicts returns true if all failed items are version conflicts (i.e.:
+// existing items on insert).
+func (e *BulkError) AllConflicts() bool {
+	if len(e.Errors) == 0 {
+		return false
+	}
+	for _, ie := range e.Errors {
+		if ie.Err != resource.ErrConflict {
+			return false
+		}
+	}
+	return true
+}
+
+// IsConflict returns true if err is resource.ErrConflict or a *BulkError of
+// which all failed items are version conflicts.
+func IsConflict(err error) bool {
+	if err == resource.ErrConflict {
+		return true
+	}
+	if be, ok := err.(*BulkError); ok {
+		return be.AllConflicts()
+	}
+	return false
+}
+
+// getBulkError returns the error reported by a bulk response, a *BulkError
+// listing each failed item.
+func getBulkError(res *elastic.BulkResponse) error {
+	return newBulkError(bulkItemErrors(res, nil))
+}
+
+// bulkItemErrors returns the failed items of a bulk response. If positions is
+// not nil, it gives the position in the caller's items of each response item,
+// when the items have been split into several bulk operations.
+func bulkItemErrors(res *elastic.BulkResponse, positions []int) []BulkItemError {
+	if !res.Errors {
+		return nil
+	}
+	errs := []BulkItemError{}
+	for i, item := range res.Items {
+		for _, r := range item {
+			if r.Error == nil {
+				continue
+			}
+			ie := BulkItemError{Index: i, ID: r.Id}
+			if positions != nil && i < len(positions) {
+				ie.Index = positions[i]
+			}
+			if isConflict(r.Error) {
+				ie.Err = resource.ErrConflict
+			} else {
+				ie.Err = fmt.Errorf("%s: %s", r.Error.Type, r.Error.Reason)
+			}
+			errs = append(errs, ie)
+		}
+	}
+	return errs
+}
+
+// newBulkError returns the error for the errs failed items, see getBulkError.
+func newBulkError(errs []BulkItemError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &BulkError{Errors: errs}
+}
@@ -0,0 +1,79 @@
+package es
+
+import (
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestGetBulkError(t *testing.T) {
+	assert.NoError(t, getBulkError(&elastic.BulkResponse{Errors: false}))
+
+	conflict := &elastic.ErrorDetails{Type: "version_conflict_engine_exception", Reason: "conflict"}
+	parse := &elastic.ErrorDetails{Type: "mapper_parsing_exception", Reason: "failed to parse"}
+	err := getBulkError(&elastic.BulkResponse{
+		Errors: true,
+		Items: []map[string]*elastic.BulkResponseItem{
+			{"create": {Id: "1", Status: 201}},
+			{"create": {Id: "2", Status: 409, Error: conflict}},
+		},
+	})
+	if assert.IsType(t, &BulkError{}, err) {
+		be := err.(*BulkError)
+		assert.True(t, be.AllConflicts())
+		assert.True(t, IsConflict(err))
+		assert.Equal(t, []BulkItemError{{Index: 1, ID: "2", Err: resource.ErrConflict}}, be.Errors)
+	}
+
+	err = getBulkError(&elastic.BulkResponse{
+		Errors: true,
+		Items: []map[string]*elastic.BulkResponseItem{
+			{"create": {Id: "1", Status: 409, Error: conflict}},
+			{"create": {Id: "2", Status: 201}},
+			{"create": {Id: "3", Status: 400, Error: parse}},
+		},
+	})
+	if assert.IsType(t, &BulkError{}, err) {
+		be := err.(*BulkError)
+		if assert.Len(t, be.Errors, 2) {
+			assert.Equal(t, 0, be.Errors[0].Index)
+			assert.Equal(t, "1", be.Errors[0].ID)
+			assert.Equal(t, resource.ErrConflict, be.Errors[0].Err)
+			assert.Equal(t, 2, be.Errors[1].Index)
+			assert.Equal(t, "3", be.Errors[1].ID)
+			assert.EqualError(t, be.Errors[1].Err, "mapper_parsing_exception: failed to parse")
+		}
+		assert.EqualError(t, err, "bulk error on 2 item(s), first on item #1 (id=1): Conflict")
+		assert.False(t, be.AllConflicts())
+		assert.False(t, IsConflict(err))
+	}
+}
+
+func TestBulkItemErrorsPositions(t *testing.T) {
+	parse := &elastic.ErrorDetails{Type: "mapper_parsing_exception", Reason: "failed to parse"}
+	errs := bulkItemErrors(&elastic.BulkResponse{
+		Errors: true,
+		Items: []map[string]*elastic.BulkResponseItem{
+			{"create": {Id: "2", Status: 201}},
+			{"create": {Id: "4", Status: 400, Error: parse}},
+		},
+	}, []int{1, 3})
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, 3, errs[0].Index)
+		assert.Equal(t, "4", errs[0].ID)
+	}
+}
+
+func TestIsConflict(t *testing.T) {
+	assert.True(t, IsConflict(resource.ErrConflict))
+	assert.False(t, IsConflict(resource.ErrNotFound))
+	assert.False(t, IsConflict(nil))
+	assert.True(t, IsConflict(&BulkError{Errors: []BulkItemError{{ID: "1", Err: resource.ErrConflict}}}))
+	assert.False(t, IsConflict(&BulkError{Errors: []BulkItemError{
+		{ID: "1", Err: resource.ErrConflict},
+		{Index: 1, ID: "2", Err: ErrTooManyRequests},
+	}}))
+	assert.False(t, IsConflict(&BulkError{}))
+}
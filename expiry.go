@@ -0,0 +1,41 @@
+package es
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// StartExpiryWorker starts a background goroutine deleting, every interval,
+// the items whose expiryField date is in the past. It replaces the _ttl field
+// removed in ES 5. The worker stops when ctx is canceled.
+//
+// The number of expired items or the error of each cleanup is reported to
+// OnExpired if set. Failed cleanups are retried at the next interval.
+func (h *Handler) StartExpiryWorker(ctx context.Context, expiryField string, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				n, err := h.expire(ctx, expiryField, time.Now())
+				if h.OnExpired != nil {
+					h.OnExpired(n, err)
+				}
+			}
+		}
+	}()
+}
+
+// expire deletes the items whose expiryField date is before now and returns
+// the number of deleted items.
+func (h *Handler) expire(ctx context.Context, expiryField string, now time.Time) (int, error) {
+	q := &query.Query{Predicate: query.Predicate{
+		&query.LowerThan{Field: expiryField, Value: now},
+	}}
+	return h.Clear(ctx, q)
+}
@@ -0,0 +1,66 @@
+package es
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestExpiryWorker(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testexpiry")()
+	h := NewHandler(c, "testexpiry", "test")
+	h.Refresh = "true"
+	now := time.Now()
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "expires": now.Add(-time.Hour)}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "expires": now.Add(-time.Minute)}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "expires": now.Add(time.Hour)}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	expired := make(chan int, 100)
+	h.OnExpired = func(n int, err error) {
+		if err == nil {
+			select {
+			case expired <- n:
+			default:
+			}
+		}
+	}
+	h.StartExpiryWorker(ctx, "expires", 100*time.Millisecond)
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var l *resource.ItemList
+	for i := 0; i < 20; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if l, err = h.Find(ctx, q); err == nil && l.Total == 1 {
+			break
+		}
+	}
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "3", l.Items[0].ID)
+	}
+	// The first cleanup reports the two expired items
+	select {
+	case n := <-expired:
+		assert.Equal(t, 2, n)
+	case <-time.After(time.Second):
+		t.Error("OnExpired not called")
+	}
+}
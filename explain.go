@@ -0,0 +1,68 @@
+package es
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// Explain returns how the document with the given id matches and scores
+// against the translated query q. This is a debugging helper to understand the
+// relevance of the items returned by Find. The explanation is only meaningful
+// in query context (see ForceQueryContext), scores being constant in filter
+// context. As with Find, q is restricted by the DocumentFilter of ctx if any.
+func (h *Handler) Explain(ctx context.Context, id string, q *query.Query) (*elastic.ExplainResponse, error) {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	qry, err := h.getQuery(h.filterQuery(ctx, q))
+	if err != nil {
+		return nil, fmt.Errorf("explain query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+	}
+	if qry == nil {
+		qry = elastic.NewMatchAllQuery()
+	}
+	routing := h.searchRouting(ctx, q)
+	if routing == "" && (h.RoutingField != "" || h.ParentIDField != "") {
+		// Without routing key, the routing of custom routed documents must be
+		// looked up on all shards
+		if routing, err = h.docRouting(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	e := h.reader().Explain(h.index, h.typ, id).Query(qry)
+	if routing != "" {
+		e.Routing(routing)
+	}
+	res, err := e.Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("explain error (index=%s, type=%s, id=%s): %v", h.index, h.typ, id, err)
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// docRouting returns the routing key of the document with the given id,
+// searched on all shards.
+func (h *Handler) docRouting(ctx context.Context, id string) (string, error) {
+	s := h.reader().Search().Index(h.index).Type(h.typ)
+	s.Query(elastic.NewIdsQuery(h.typ).Ids(id)).Size(1).FetchSource(false)
+	if p := h.preference(ctx); p != "" {
+		s.Preference(p)
+	}
+	res, err := s.Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("explain routing error (index=%s, type=%s, id=%s): %v", h.index, h.typ, id, err)
+		}
+		return "", err
+	}
+	if res.Hits == nil || len(res.Hits.Hits) == 0 {
+		return "", resource.ErrNotFound
+	}
+	return res.Hits.Hits[0].Routing, nil
+}
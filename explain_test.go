@@ -0,0 +1,86 @@
+package es
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestExplain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testexplain")()
+	h := NewHandler(c, "testexplain", "test")
+	h.Refresh = "true"
+	h.ForceQueryContext = true
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{name:"a"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := h.Explain(ctx, "1", q)
+	if assert.NoError(t, err) {
+		assert.True(t, res.Matched)
+		assert.NotNil(t, res.Explanation)
+	}
+	res, err = h.Explain(ctx, "2", q)
+	if assert.NoError(t, err) {
+		assert.False(t, res.Matched)
+	}
+}
+
+func TestExplainFilterAndRouting(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testexplainrouting")()
+	h := NewHandler(c, "testexplainrouting", "test", WithShards(4))
+	h.Refresh = "true"
+	h.ForceQueryContext = true
+	h.RoutingField = "tenant"
+	h.DocumentFilter = tenantFilter
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a", "tenant": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "a", "tenant": "b"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{name:"a"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	actx := context.WithValue(ctx, tenantCtxKey{}, "a")
+	// Routed documents are found without routing key in the query
+	res, err := h.Explain(actx, "1", q)
+	if assert.NoError(t, err) {
+		assert.True(t, res.Matched)
+	}
+	// Documents of other tenants never match
+	res, err = h.Explain(actx, "2", q)
+	if assert.NoError(t, err) {
+		assert.False(t, res.Matched)
+	}
+	_, err = h.Explain(actx, "3", q)
+	assert.Equal(t, resource.ErrNotFound, err)
+}
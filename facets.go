@@ -0,0 +1,182 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// Facet is a facet computed by FindWithFacets. It is implemented by
+// TermsFacet and DateHistogramFacet.
+type Facet interface {
+	// field returns the name of the faceted field.
+	field() string
+	// aggregation returns the ES aggregation computing the facet.
+	aggregation(h *Handler, size int) elastic.Aggregation
+	// buckets returns the facet buckets from the search aggregation name.
+	buckets(aggs elastic.Aggregations, name string) []FacetBucket
+}
+
+// TermsFacet is a facet returning the most frequent values of Field.
+type TermsFacet struct {
+	Field string
+}
+
+func (f TermsFacet) field() string {
+	return f.Field
+}
+
+func (f TermsFacet) aggregation(h *Handler, size int) elastic.Aggregation {
+	return elastic.NewTermsAggregation().Field(h.getField(f.Field, true)).Size(size)
+}
+
+func (f TermsFacet) buckets(aggs elastic.Aggregations, name string) []FacetBucket {
+	buckets := []FacetBucket{}
+	terms, found := aggs.Terms(name)
+	if !found {
+		return buckets
+	}
+	for _, b := range terms.Buckets {
+		var v interface{} = b.Key
+		if b.KeyAsString != nil {
+			v = *b.KeyAsString
+		}
+		buckets = append(buckets, FacetBucket{Value: v, Count: int(b.DocCount)})
+	}
+	return buckets
+}
+
+// DateHistogramFacet is a facet counting the items per Interval (i.e.: 1d, 1w,
+// 1M or day, week, month) of the date Field. Empty intervals are returned with
+// a 0 count.
+type DateHistogramFacet struct {
+	Field    string
+	Interval string
+}
+
+func (f DateHistogramFacet) field() string {
+	return f.Field
+}
+
+func (f DateHistogramFacet) aggregation(h *Handler, size int) elastic.Aggregation {
+	return elastic.NewDateHistogramAggregation().Field(h.getField(f.Field, false)).Interval(f.Interval)
+}
+
+func (f DateHistogramFacet) buckets(aggs elastic.Aggregations, name string) []FacetBucket {
+	buckets := []FacetBucket{}
+	histo, found := aggs.DateHistogram(name)
+	if !found {
+		return buckets
+	}
+	for _, b := range histo.Buckets {
+		// Keys are epoch timestamps in milliseconds
+		k := time.Unix(0, int64(b.Key)*int64(time.Millisecond)).UTC()
+		buckets = append(buckets, FacetBucket{Value: k, Key: k, Count: int(b.DocCount)})
+	}
+	return buckets
+}
+
+// facetName returns the name of the aggregation computing the i-th facet, so
+// several facets can apply to the same field.
+func facetName(i int) string {
+	return fmt.Sprintf("facet_%d", i)
+}
+
+// FacetResult holds the buckets of a facet computed among the items matching a
+// query.
+type FacetResult struct {
+	Field   string
+	Buckets []FacetBucket
+}
+
+// FacetBucket holds a field value with the number of matching items having
+// this value.
+type FacetBucket struct {
+	Value interface{}
+	// Key is the start of the interval for date histogram facets.
+	Key   time.Time
+	Count int
+}
+
+// FindWithFacets finds items matching q like Find and computes, in the same ES
+// request, the facets among all the matching items (not only the returned
+// page). Terms facets return the facetSize most frequent values of their
+// field. Facets are returned in facets order, a field can thus be faceted
+// several times (i.e.: per day and per month).
+func (h *Handler) FindWithFacets(ctx context.Context, q *query.Query, facets []Facet, facetSize int) (*resource.ItemList, []FacetResult, error) {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	q = h.filterQuery(ctx, q)
+	qry, err := h.getQuery(q)
+	if err != nil {
+		return nil, nil, fmt.Errorf("find query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+	}
+	s, err := h.newSearch(ctx, q, qry)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, f := range facets {
+		s.Aggregation(facetName(i), f.aggregation(h, facetSize))
+	}
+	res, err := h.search(ctx, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := buildItemList(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make([]FacetResult, len(facets))
+	for i, f := range facets {
+		results[i] = FacetResult{Field: f.field(), Buckets: f.buckets(res.Aggregations, facetName(i))}
+	}
+	return list, results, nil
+}
+
+// FindResult is the result of FindWithAggregations.
+type FindResult struct {
+	*resource.ItemList
+	// Aggregations holds the raw ES result of each requested aggregation,
+	// keyed by aggregation name.
+	Aggregations map[string]json.RawMessage
+}
+
+// FindWithAggregations finds items matching q like Find, and computes aggs
+// among all the matching items (not only the returned page). Unlike facets,
+// any ES aggregation can be requested, its result being returned unparsed.
+func (h *Handler) FindWithAggregations(ctx context.Context, q *query.Query, aggs map[string]elastic.Aggregation) (*FindResult, error) {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	q = h.filterQuery(ctx, q)
+	qry, err := h.getQuery(q)
+	if err != nil {
+		return nil, fmt.Errorf("find query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+	}
+	s, err := h.newSearch(ctx, q, qry)
+	if err != nil {
+		return nil, err
+	}
+	for name, agg := range aggs {
+		s.Aggregation(name, agg)
+	}
+	res, err := h.search(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	list, err := buildItemList(res)
+	if err != nil {
+		return nil, err
+	}
+	result := &FindResult{ItemList: list, Aggregations: map[string]json.RawMessage{}}
+	for name, raw := range res.Aggregations {
+		if raw != nil {
+			result.Aggregations[name] = *raw
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,209 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestFindWithFacets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindfacets")()
+	h := NewHandler(c, "testfindfacets", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "category": "a", "color": "red"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "category": "a", "color": "blue"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "category": "b", "color": "red"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "category": "c", "color": "red"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{color:"red"}`, "", query.Page(1, 1, 0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, facets, err := h.FindWithFacets(ctx, q, []Facet{TermsFacet{"category"}, TermsFacet{"color"}}, 10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, l.Total)
+		assert.Len(t, l.Items, 1)
+		assert.Equal(t, []FacetResult{
+			{Field: "category", Buckets: []FacetBucket{{Value: "a", Count: 1}, {Value: "b", Count: 1}, {Value: "c", Count: 1}}},
+			{Field: "color", Buckets: []FacetBucket{{Value: "red", Count: 3}}},
+		}, facets)
+	}
+}
+
+func TestFindWithFacetsPostFilter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindfacetspostfilter")()
+	h := NewHandler(c, "testfindfacetspostfilter", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "category": "a", "color": "red"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "category": "a", "color": "blue"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "category": "b", "color": "red"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pf, err := query.New("", `{category:"b"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Facets count all items while only the items of category b are returned
+	l, facets, err := h.FindWithFacets(WithPostFilter(ctx, pf), q, []Facet{TermsFacet{"category"}}, 10)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "3", l.Items[0].ID)
+		assert.Equal(t, []FacetResult{
+			{Field: "category", Buckets: []FacetBucket{{Value: "a", Count: 2}, {Value: "b", Count: 1}}},
+		}, facets)
+	}
+}
+
+func TestFindWithDateHistogramFacets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindfacetsdate")()
+	h := NewHandler(c, "testfindfacetsdate", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "at": "2017-01-02T10:00:00Z"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "at": "2017-01-02T12:00:00Z"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "at": "2017-01-04T10:00:00Z"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "at": "2017-02-15T10:00:00Z"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	counts := func(buckets []FacetBucket) map[time.Time]int {
+		m := map[time.Time]int{}
+		for _, b := range buckets {
+			if b.Count > 0 {
+				m[b.Key] = b.Count
+			}
+		}
+		return m
+	}
+	_, facets, err := h.FindWithFacets(ctx, q, []Facet{DateHistogramFacet{Field: "at", Interval: "day"}}, 0)
+	if assert.NoError(t, err) && assert.Len(t, facets, 1) {
+		assert.Equal(t, map[time.Time]int{
+			day("2017-01-02"): 2,
+			day("2017-01-04"): 1,
+			day("2017-02-15"): 1,
+		}, counts(facets[0].Buckets))
+	}
+	_, facets, err = h.FindWithFacets(ctx, q, []Facet{DateHistogramFacet{Field: "at", Interval: "week"}}, 0)
+	if assert.NoError(t, err) && assert.Len(t, facets, 1) {
+		// Weeks start on Monday
+		assert.Equal(t, map[time.Time]int{
+			day("2017-01-02"): 3,
+			day("2017-02-13"): 1,
+		}, counts(facets[0].Buckets))
+	}
+	_, facets, err = h.FindWithFacets(ctx, q, []Facet{DateHistogramFacet{Field: "at", Interval: "month"}}, 0)
+	if assert.NoError(t, err) && assert.Len(t, facets, 1) {
+		assert.Equal(t, map[time.Time]int{
+			day("2017-01-01"): 3,
+			day("2017-02-01"): 1,
+		}, counts(facets[0].Buckets))
+	}
+	// Facets on the same field do not overwrite each other
+	_, facets, err = h.FindWithFacets(ctx, q, []Facet{
+		DateHistogramFacet{Field: "at", Interval: "month"},
+		DateHistogramFacet{Field: "at", Interval: "day"},
+	}, 0)
+	if assert.NoError(t, err) && assert.Len(t, facets, 2) {
+		assert.Equal(t, map[time.Time]int{
+			day("2017-01-01"): 3,
+			day("2017-02-01"): 1,
+		}, counts(facets[0].Buckets))
+		assert.Equal(t, map[time.Time]int{
+			day("2017-01-02"): 2,
+			day("2017-01-04"): 1,
+			day("2017-02-15"): 1,
+		}, counts(facets[1].Buckets))
+	}
+}
+
+func TestFindWithAggregationsResult(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindaggregationsresult")()
+	h := NewHandler(c, "testfindaggregationsresult", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "category": "a", "color": "red"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "category": "a", "color": "blue"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "category": "b", "color": "red"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{color:"red"}`, "", query.Page(1, 1, 0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := h.FindWithAggregations(ctx, q, map[string]elastic.Aggregation{
+		"categories": elastic.NewTermsAggregation().Field("category.keyword"),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2, res.Total)
+	assert.Len(t, res.Items, 1)
+	if assert.Contains(t, res.Aggregations, "categories") {
+		terms := struct {
+			Buckets []struct {
+				Key      string `json:"key"`
+				DocCount int    `json:"doc_count"`
+			} `json:"buckets"`
+		}{}
+		if assert.NoError(t, json.Unmarshal(res.Aggregations["categories"], &terms)) && assert.Len(t, terms.Buckets, 2) {
+			assert.Equal(t, "a", terms.Buckets[0].Key)
+			assert.Equal(t, 1, terms.Buckets[0].DocCount)
+			assert.Equal(t, "b", terms.Buckets[1].Key)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package es
+
+import "github.com/rs/rest-layer/schema"
+
+// FieldTypeProvider gives information on how fields are mapped in
+// ElasticSearch so queries can target them appropriately.
+type FieldTypeProvider interface {
+	// IsKeyword returns true if queries and sorts on field must target its
+	// .keyword sub-field.
+	IsKeyword(field string) bool
+	// IsNested returns the path of the nested object containing field, or an
+	// empty string if field is not part of a nested object.
+	IsNested(field string) string
+}
+
+type schemaFieldTypes struct {
+	s schema.Schema
+}
+
+// SchemaFieldTypeProvider returns a FieldTypeProvider reading field types from
+// a REST Layer schema. It assumes the index uses ES default dynamic mapping, in
+// which string fields are mapped as text with a .keyword sub-field. As the
+// schema does not tell if an object is mapped as nested, no field is reported
+// as nested.
+func SchemaFieldTypeProvider(s schema.Schema) FieldTypeProvider {
+	return schemaFieldTypes{s: s}
+}
+
+// IsKeyword implements the FieldTypeProvider interface.
+func (p schemaFieldTypes) IsKeyword(field string) bool {
+	f := p.s.GetField(field)
+	if f == nil {
+		return false
+	}
+	switch f.Validator.(type) {
+	case *schema.String, *schema.Reference, *schema.URL, *schema.IP:
+		return true
+	}
+	return false
+}
+
+// IsNested implements the FieldTypeProvider interface.
+func (p schemaFieldTypes) IsNested(field string) string {
+	return ""
+}
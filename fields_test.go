@@ -0,0 +1,74 @@
+package es
+
+import (
+	"testing"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+type nestedFieldTypes map[string]string
+
+func (n nestedFieldTypes) IsKeyword(field string) bool {
+	return true
+}
+
+func (n nestedFieldTypes) IsNested(field string) string {
+	return n[field]
+}
+
+func TestSchemaFieldTypeProvider(t *testing.T) {
+	p := SchemaFieldTypeProvider(schema.Schema{
+		Fields: schema.Fields{
+			"name": {Validator: &schema.String{}},
+			"ref":  {Validator: &schema.Reference{Path: "users"}},
+			"age":  {Validator: &schema.Integer{}},
+			"sub": {
+				Schema: &schema.Schema{
+					Fields: schema.Fields{
+						"label": {Validator: &schema.String{}},
+						"count": {Validator: &schema.Integer{}},
+					},
+				},
+			},
+		},
+	})
+	assert.True(t, p.IsKeyword("name"))
+	assert.True(t, p.IsKeyword("ref"))
+	assert.False(t, p.IsKeyword("age"))
+	assert.True(t, p.IsKeyword("sub.label"))
+	assert.False(t, p.IsKeyword("sub.count"))
+	assert.False(t, p.IsKeyword("unknown"))
+	assert.Equal(t, "", p.IsNested("sub.label"))
+}
+
+func TestGetFieldWithProvider(t *testing.T) {
+	h := NewHandler(nil, "index", "type", WithFieldTypeProvider(SchemaFieldTypeProvider(schema.Schema{
+		Fields: schema.Fields{
+			"name": {Validator: &schema.String{}},
+			"age":  {Validator: &schema.Integer{}},
+		},
+	})))
+	assert.Equal(t, "_id", h.getField("id", true))
+	assert.Equal(t, "name.keyword", h.getField("name", true))
+	assert.Equal(t, "name.keyword", h.getField("name", false))
+	assert.Equal(t, "age", h.getField("age", true))
+	assert.Equal(t, "age", h.getField("age", false))
+}
+
+func TestGetQueryNested(t *testing.T) {
+	h := NewHandler(nil, "index", "type", WithFieldTypeProvider(nestedFieldTypes{"author.name": "author"}))
+	q, err := query.New("", `{"author.name":"foo",f:"bar"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	got, err := h.getQuery(q)
+	assert.NoError(t, err)
+	want := elastic.NewBoolQuery().Filter(
+		elastic.NewNestedQuery("author", elastic.NewTermQuery("author.name.keyword", "foo")),
+		elastic.NewTermQuery("f.keyword", "bar"),
+	)
+	assert.Equal(t, want, got)
+}
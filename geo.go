@@ -0,0 +1,219 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rs/rest-layer/schema"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// GeoPoint is a geographical point.
+type GeoPoint struct {
+	Lat float64
+	Lon float64
+}
+
+// GeoPolygon is a query expression matching items whose Field geo point is
+// inside the polygon made of Points, translated into an ES geo_polygon query.
+// Note that geo_polygon is deprecated as of ES 7.12 in favour of geo_shape
+// queries (see GeoShape), which also apply to geo_point fields from then on.
+type GeoPolygon struct {
+	Field  string
+	Points []GeoPoint
+}
+
+// Match implements query.Expression interface.
+func (p GeoPolygon) Match(payload map[string]interface{}) bool {
+	pt, ok := geoPointValue(payload[p.Field])
+	return ok && insidePolygon(pt, p.Points)
+}
+
+// Prepare implements query.Expression interface.
+func (p *GeoPolygon) Prepare(validator schema.Validator) error {
+	if err := prepareField(p.Field, validator); err != nil {
+		return err
+	}
+	if len(p.Points) < 3 {
+		return fmt.Errorf("%s: polygon needs at least 3 points", p.Field)
+	}
+	return nil
+}
+
+// String implements query.Expression interface.
+func (p GeoPolygon) String() string {
+	points := make([]string, len(p.Points))
+	for i, pt := range p.Points {
+		points[i] = fmt.Sprintf("[%v, %v]", pt.Lat, pt.Lon)
+	}
+	return fmt.Sprintf("%s: {$geoPolygon: [%s]}", p.Field, strings.Join(points, ", "))
+}
+
+// Geo shape relations supported by GeoShape.
+var geoShapeRelations = map[string]bool{
+	"intersects": true,
+	"within":     true,
+	"contains":   true,
+	"disjoint":   true,
+}
+
+// GeoShape is a query expression matching items whose Field shape has the
+// given Relation with the GeoJSON shape, translated into an ES geo_shape query.
+// Relation is one of intersects (the default), within, contains or disjoint.
+//
+// The shape is sent to ES as is, so any GeoJSON geometry supported by ES can
+// be used. Match, used when the items are not fetched from ES, only supports
+// geo point fields and Polygon shapes and never matches otherwise.
+type GeoShape struct {
+	Field    string
+	GeoJSON  json.RawMessage
+	Relation string
+}
+
+// Match implements query.Expression interface.
+func (s GeoShape) Match(payload map[string]interface{}) bool {
+	pt, ok := geoPointValue(payload[s.Field])
+	if !ok {
+		return false
+	}
+	shape := struct {
+		Type        string
+		Coordinates [][][2]float64
+	}{}
+	if err := json.Unmarshal(s.GeoJSON, &shape); err != nil || shape.Type != "Polygon" || len(shape.Coordinates) == 0 {
+		return false
+	}
+	// The first ring is the exterior of the polygon, the others are holes
+	rings := make([][]GeoPoint, len(shape.Coordinates))
+	for i, coords := range shape.Coordinates {
+		rings[i] = make([]GeoPoint, len(coords))
+		for j, c := range coords {
+			rings[i][j] = GeoPoint{Lat: c[1], Lon: c[0]}
+		}
+	}
+	inside := insidePolygon(pt, rings[0])
+	for _, hole := range rings[1:] {
+		if inside && insidePolygon(pt, hole) {
+			inside = false
+		}
+	}
+	switch s.Relation {
+	case "", "intersects", "within":
+		return inside
+	case "disjoint":
+		return !inside
+	}
+	// A point cannot contain a polygon
+	return false
+}
+
+// Prepare implements query.Expression interface.
+func (s *GeoShape) Prepare(validator schema.Validator) error {
+	if err := prepareField(s.Field, validator); err != nil {
+		return err
+	}
+	if s.Relation != "" && !geoShapeRelations[s.Relation] {
+		return fmt.Errorf("%s: invalid geo shape relation: %s", s.Field, s.Relation)
+	}
+	shape := struct {
+		Type string
+	}{}
+	if err := json.Unmarshal(s.GeoJSON, &shape); err != nil {
+		return fmt.Errorf("%s: invalid GeoJSON shape: %v", s.Field, err)
+	}
+	if shape.Type == "" {
+		return fmt.Errorf("%s: invalid GeoJSON shape: missing type", s.Field)
+	}
+	return nil
+}
+
+// String implements query.Expression interface.
+func (s GeoShape) String() string {
+	relation := s.Relation
+	if relation == "" {
+		relation = "intersects"
+	}
+	return fmt.Sprintf("%s: {$geoShape: %s, $relation: %s}", s.Field, s.GeoJSON, relation)
+}
+
+// geoShapeQuery returns the ES geo_shape query of s. The elastic client not
+// providing a geo_shape query builder for inline shapes, the query is built
+// from its JSON source.
+func (h *Handler) geoShapeQuery(s *GeoShape) (elastic.Query, error) {
+	shape := map[string]interface{}{"shape": s.GeoJSON}
+	if s.Relation != "" {
+		shape["relation"] = s.Relation
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"geo_shape": map[string]interface{}{h.getField(s.Field, false): shape},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return elastic.NewRawStringQuery(string(b)), nil
+}
+
+// prepareField returns an error if field is not a filterable field of
+// validator, like REST Layer expressions do.
+func prepareField(field string, validator schema.Validator) error {
+	f := validator.GetField(field)
+	if f == nil {
+		return fmt.Errorf("%s: unknown query field", field)
+	}
+	if !f.Filterable {
+		return fmt.Errorf("%s: field is not filterable", field)
+	}
+	return nil
+}
+
+// geoPointValue returns the geo point of a payload value, in one of the
+// formats accepted by ES geo_point fields: an object with lat and lon, a
+// [lon, lat] array or a "lat,lon" string.
+func geoPointValue(v interface{}) (GeoPoint, bool) {
+	switch t := v.(type) {
+	case GeoPoint:
+		return t, true
+	case map[string]interface{}:
+		lat, latOK := t["lat"].(float64)
+		lon, lonOK := t["lon"].(float64)
+		return GeoPoint{Lat: lat, Lon: lon}, latOK && lonOK
+	case []interface{}:
+		if len(t) != 2 {
+			return GeoPoint{}, false
+		}
+		lon, lonOK := t[0].(float64)
+		lat, latOK := t[1].(float64)
+		return GeoPoint{Lat: lat, Lon: lon}, latOK && lonOK
+	case string:
+		parts := strings.Split(t, ",")
+		if len(parts) != 2 {
+			return GeoPoint{}, false
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err != nil {
+			return GeoPoint{}, false
+		}
+		lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return GeoPoint{}, false
+		}
+		return GeoPoint{Lat: lat, Lon: lon}, true
+	}
+	return GeoPoint{}, false
+}
+
+// insidePolygon returns true if pt is inside the polygon made of points, using
+// the even-odd rule on a flat projection of the coordinates.
+func insidePolygon(pt GeoPoint, points []GeoPoint) bool {
+	inside := false
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		a, b := points[i], points[j]
+		if (a.Lat > pt.Lat) != (b.Lat > pt.Lat) &&
+			pt.Lon < (b.Lon-a.Lon)*(pt.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
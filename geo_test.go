@@ -0,0 +1,155 @@
+package es
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+)
+
+var testPolygon = []GeoPoint{{Lat: 40, Lon: -70}, {Lat: 30, Lon: -80}, {Lat: 20, Lon: -90}, {Lat: 40, Lon: -90}}
+
+func TestGetQueryGeoPolygon(t *testing.T) {
+	h := &Handler{ForceQueryContext: true}
+	got, err := h.getQuery(&query.Query{Predicate: query.Predicate{
+		&GeoPolygon{Field: "loc", Points: testPolygon},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	src, err := got.Source()
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := json.Marshal(src)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"geo_polygon":{"loc":{"points":[
+		{"lat":40,"lon":-70},{"lat":30,"lon":-80},{"lat":20,"lon":-90},{"lat":40,"lon":-90}
+	]}}}`, string(b))
+
+	h = &Handler{ForceQueryContext: true, QueryName: "geo"}
+	got, err = h.getQuery(&query.Query{Predicate: query.Predicate{
+		&GeoPolygon{Field: "loc", Points: testPolygon},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	src, err = got.Source()
+	assert.NoError(t, err)
+	assert.Equal(t, "geo", src.(map[string]interface{})["geo_polygon"].(map[string]interface{})["_name"])
+}
+
+func TestGeoPolygonMatch(t *testing.T) {
+	p := GeoPolygon{Field: "loc", Points: testPolygon}
+	cases := []struct {
+		name  string
+		value interface{}
+		want  bool
+	}{
+		{"object inside", map[string]interface{}{"lat": 35.0, "lon": -85.0}, true},
+		{"object outside", map[string]interface{}{"lat": 35.0, "lon": -70.0}, false},
+		{"array inside", []interface{}{-85.0, 35.0}, true},
+		{"array outside", []interface{}{35.0, -85.0}, false},
+		{"string inside", "35, -85", true},
+		{"string outside", "10,-85", false},
+		{"invalid string", "35", false},
+		{"invalid type", 35.0, false},
+		{"missing", nil, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, p.Match(map[string]interface{}{"loc": tc.value}))
+		})
+	}
+}
+
+func TestGeoPolygonPrepare(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"loc":  {Filterable: true},
+		"name": {},
+	}}
+	assert.NoError(t, (&GeoPolygon{Field: "loc", Points: testPolygon}).Prepare(s))
+	assert.EqualError(t, (&GeoPolygon{Field: "foo", Points: testPolygon}).Prepare(s), "foo: unknown query field")
+	assert.EqualError(t, (&GeoPolygon{Field: "name", Points: testPolygon}).Prepare(s), "name: field is not filterable")
+	assert.EqualError(t, (&GeoPolygon{Field: "loc", Points: testPolygon[:2]}).Prepare(s), "loc: polygon needs at least 3 points")
+}
+
+func TestGeoPolygonString(t *testing.T) {
+	p := GeoPolygon{Field: "loc", Points: testPolygon[:3]}
+	assert.Equal(t, "loc: {$geoPolygon: [[40, -70], [30, -80], [20, -90]]}", p.String())
+}
+
+const testShape = `{"type":"Polygon","coordinates":[
+	[[-90,20],[-70,20],[-70,40],[-90,40],[-90,20]],
+	[[-82,28],[-78,28],[-78,32],[-82,32],[-82,28]]
+]}`
+
+func TestGetQueryGeoShape(t *testing.T) {
+	cases := []struct {
+		name  string
+		shape *GeoShape
+		want  string
+	}{
+		{"default relation", &GeoShape{Field: "area", GeoJSON: json.RawMessage(testShape)},
+			`{"geo_shape":{"area":{"shape":` + testShape + `}}}`},
+		{"within", &GeoShape{Field: "area", GeoJSON: json.RawMessage(testShape), Relation: "within"},
+			`{"geo_shape":{"area":{"shape":` + testShape + `,"relation":"within"}}}`},
+	}
+	h := &Handler{ForceQueryContext: true}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := h.getQuery(&query.Query{Predicate: query.Predicate{tc.shape}})
+			if !assert.NoError(t, err) {
+				return
+			}
+			src, err := got.Source()
+			if !assert.NoError(t, err) {
+				return
+			}
+			b, err := json.Marshal(src)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.want, string(b))
+		})
+	}
+}
+
+func TestGeoShapeMatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		relation string
+		value    interface{}
+		want     bool
+	}{
+		{"inside", "", "25,-85", true},
+		{"in hole", "", "30,-80", false},
+		{"outside", "", "50,-80", false},
+		{"within", "within", "25,-85", true},
+		{"disjoint inside", "disjoint", "25,-85", false},
+		{"disjoint in hole", "disjoint", "30,-80", true},
+		{"contains", "contains", "25,-85", false},
+		{"not a point", "", "foo", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := GeoShape{Field: "loc", GeoJSON: json.RawMessage(testShape), Relation: tc.relation}
+			assert.Equal(t, tc.want, s.Match(map[string]interface{}{"loc": tc.value}))
+		})
+	}
+	s := GeoShape{Field: "loc", GeoJSON: json.RawMessage(`{"type":"LineString","coordinates":[[-90,20],[-70,40]]}`)}
+	assert.False(t, s.Match(map[string]interface{}{"loc": "30,-80"}))
+}
+
+func TestGeoShapePrepare(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"area": {Filterable: true},
+	}}
+	shape := json.RawMessage(testShape)
+	assert.NoError(t, (&GeoShape{Field: "area", GeoJSON: shape}).Prepare(s))
+	assert.NoError(t, (&GeoShape{Field: "area", GeoJSON: shape, Relation: "disjoint"}).Prepare(s))
+	assert.EqualError(t, (&GeoShape{Field: "foo", GeoJSON: shape}).Prepare(s), "foo: unknown query field")
+	assert.EqualError(t, (&GeoShape{Field: "area", GeoJSON: shape, Relation: "overlaps"}).Prepare(s), "area: invalid geo shape relation: overlaps")
+	assert.EqualError(t, (&GeoShape{Field: "area", GeoJSON: json.RawMessage(`{}`)}).Prepare(s), "area: invalid GeoJSON shape: missing type")
+	assert.Error(t, (&GeoShape{Field: "area", GeoJSON: json.RawMessage(`{`)}).Prepare(s))
+}
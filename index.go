@@ -0,0 +1,344 @@
+package es
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// EnsureIndex creates the handler's index with IndexSettings and the
+// FielddataFields and NormalizeKeywords mappings if it does not exist yet.
+// Settings of an existing index are left untouched. If a minimum version is
+// set with WithVersionCheck, the version of the cluster is checked first.
+func (h *Handler) EnsureIndex(ctx context.Context) error {
+	mapping := map[string]interface{}{}
+	if len(h.FielddataFields) > 0 {
+		props, err := fielddataProperties(h.FielddataFields)
+		if err != nil {
+			return fmt.Errorf("ensure index error (index=%s): %v", h.index, err)
+		}
+		mapping["properties"] = props
+	}
+	if h.minVersion != "" {
+		if err := h.RequireVersion(ctx, h.minVersion); err != nil {
+			return err
+		}
+	}
+	exists, err := h.client.IndexExists(h.index).Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("ensure index error (index=%s): %v", h.index, err)
+		}
+		return err
+	}
+	if exists {
+		return nil
+	}
+	body := map[string]interface{}{}
+	settings := map[string]interface{}{}
+	for name, value := range h.IndexSettings {
+		settings[name] = value
+	}
+	if h.NormalizeKeywords {
+		for name, value := range normalizerSettings {
+			settings[name] = value
+		}
+		mapping["dynamic_templates"] = []interface{}{
+			map[string]interface{}{"strings": normalizedStringsTemplate},
+		}
+	}
+	if len(settings) > 0 {
+		body["settings"] = settings
+	}
+	if len(mapping) > 0 {
+		body["mappings"] = map[string]interface{}{h.typ: mapping}
+	}
+	_, err = h.client.CreateIndex(h.index).BodyJson(body).Do(ctx)
+	if err != nil && !isAlreadyExists(err) {
+		if !translateError(&err) {
+			err = fmt.Errorf("ensure index creation error (index=%s): %v", h.index, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// normalizerSettings defines the lowercase keyword normalizer (ES 5.2+).
+var normalizerSettings = map[string]interface{}{
+	"analysis.normalizer.lowercase.type":   "custom",
+	"analysis.normalizer.lowercase.filter": []string{"lowercase"},
+}
+
+// normalizedStringsTemplate is the dynamic template mapping strings like ES
+// default dynamic mapping but with the .keyword sub-field normalized with the
+// lowercase normalizer.
+var normalizedStringsTemplate = map[string]interface{}{
+	"match_mapping_type": "string",
+	"mapping": map[string]interface{}{
+		"type": "text",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{
+				"type":         "keyword",
+				"ignore_above": 256,
+				"normalizer":   "lowercase",
+			},
+		},
+	},
+}
+
+// EnsureNormalizerSettings adds the lowercase normalizer used by
+// NormalizeKeywords to the analysis settings of the existing handler's index.
+// Analysis settings can only be changed on a closed index, so the index is
+// closed, and thus unavailable, during the update.
+func (h *Handler) EnsureNormalizerSettings(ctx context.Context) error {
+	if _, err := h.client.CloseIndex(h.index).Do(ctx); err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("close index error (index=%s): %v", h.index, err)
+		}
+		return err
+	}
+	err := h.putSettings(ctx, normalizerSettings)
+	// Always reopen the index, even if the update failed
+	if _, oerr := h.client.OpenIndex(h.index).Do(ctx); oerr != nil && err == nil {
+		err = oerr
+		if !translateError(&err) {
+			err = fmt.Errorf("open index error (index=%s): %v", h.index, err)
+		}
+	}
+	return err
+}
+
+// IndexPattern returns the name of the index storing item, see
+// Handler.IndexSelector.
+type IndexPattern func(item *resource.Item) string
+
+// DateRollingPattern returns an IndexPattern storing items in time based
+// rolling indices named base-<date>, where date is the item's Updated time
+// (UTC) formatted with the time.Format layout (i.e.: "2006.01.02" for daily
+// indices). The handler's index should then be "base-*" so searches cover all
+// the rolling indices.
+//
+// As updates change the Updated time, updated items stay in the index of the
+// original item.
+func DateRollingPattern(base, layout string) IndexPattern {
+	return func(item *resource.Item) string {
+		t := item.Updated
+		if t.IsZero() {
+			t = time.Now()
+		}
+		return base + "-" + t.UTC().Format(layout)
+	}
+}
+
+// setIndexSetting sets an index setting in IndexSettings.
+func (h *Handler) setIndexSetting(name string, value interface{}) {
+	if h.IndexSettings == nil {
+		h.IndexSettings = map[string]interface{}{}
+	}
+	h.IndexSettings[name] = value
+}
+
+// isAlreadyExists returns true if err is the error returned by ES when creating
+// an index which already exists.
+func isAlreadyExists(err error) bool {
+	if e, ok := err.(*elastic.Error); ok && e.Details != nil {
+		switch e.Details.Type {
+		case "index_already_exists_exception", "resource_already_exists_exception":
+			return true
+		}
+	}
+	return false
+}
+
+// CreateFilteredAlias creates an alias on the handler's index restricted to the
+// documents matching filterQuery. Operations performed through the alias, for
+// instance by a handler created on the alias, are automatically scoped to those
+// documents, which can be used to isolate tenants sharing the same index.
+func (h *Handler) CreateFilteredAlias(ctx context.Context, alias string, filterQuery *query.Query) error {
+	a := elastic.NewAliasAddAction(alias).Index(h.index)
+	qry, err := h.getQuery(filterQuery)
+	if err != nil {
+		return fmt.Errorf("create alias query translation error (index=%s, alias=%s): %v", h.index, alias, err)
+	}
+	if qry != nil {
+		a.Filter(qry)
+	}
+	_, err = h.client.Alias().Action(a).Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("create alias error (index=%s, alias=%s): %v", h.index, alias, err)
+		}
+	}
+	return err
+}
+
+// SetRefreshInterval changes the refresh interval of the handler's index.
+// Setting it to "-1" disables refresh, which speeds up bulk loads. Use
+// RestoreDefaultRefreshInterval or any duration like "1s" or "30s" to enable it
+// back once the load is done.
+func (h *Handler) SetRefreshInterval(ctx context.Context, interval string) error {
+	return h.putSettings(ctx, map[string]interface{}{"refresh_interval": interval})
+}
+
+// RestoreDefaultRefreshInterval sets the refresh interval of the handler's
+// index back to ES default of 1 second.
+func (h *Handler) RestoreDefaultRefreshInterval(ctx context.Context) error {
+	return h.SetRefreshInterval(ctx, "1s")
+}
+
+// putSettings updates the dynamic settings of the handler's index.
+func (h *Handler) putSettings(ctx context.Context, settings map[string]interface{}) error {
+	_, err := h.client.IndexPutSettings(h.index).BodyJson(map[string]interface{}{"index": settings}).Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("put settings error (index=%s): %v", h.index, err)
+		}
+	}
+	return err
+}
+
+// UpdateReplicas changes the number of replicas of each primary shard of the
+// existing handler's index.
+func (h *Handler) UpdateReplicas(ctx context.Context, n int) error {
+	return h.putSettings(ctx, map[string]interface{}{"number_of_replicas": n})
+}
+
+// indexBlockSetting returns the index setting of the block ("write", "read",
+// "read_only" or "metadata_write").
+func indexBlockSetting(block string) (string, error) {
+	switch block {
+	case "write", "read", "read_only":
+		return "blocks." + block, nil
+	case "metadata_write":
+		return "blocks.metadata", nil
+	default:
+		return "", fmt.Errorf("invalid index block: %q", block)
+	}
+}
+
+// SetIndexBlock sets block ("write", "read", "read_only" or "metadata_write")
+// on the handler's index, for instance to make it read-only before shrinking
+// it. The add index block API is not available with ES 5, so the block is set
+// through the index settings.
+func (h *Handler) SetIndexBlock(ctx context.Context, block string) error {
+	setting, err := indexBlockSetting(block)
+	if err != nil {
+		return err
+	}
+	return h.putSettings(ctx, map[string]interface{}{setting: true})
+}
+
+// ClearIndexBlock removes block, set with SetIndexBlock, from the handler's
+// index.
+func (h *Handler) ClearIndexBlock(ctx context.Context, block string) error {
+	setting, err := indexBlockSetting(block)
+	if err != nil {
+		return err
+	}
+	return h.putSettings(ctx, map[string]interface{}{setting: false})
+}
+
+// getSettings returns the flat settings of the handler's index.
+func (h *Handler) getSettings(ctx context.Context) (map[string]interface{}, error) {
+	res, err := h.client.IndexGetSettings(h.index).FlatSettings(true).Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("get settings error (index=%s): %v", h.index, err)
+		}
+		return nil, err
+	}
+	for _, r := range res {
+		// An alias may resolve to another index name
+		return r.Settings, nil
+	}
+	return nil, resource.ErrNotFound
+}
+
+// CanShrink checks the prerequisites of an index shrink on the handler's
+// index: the index must be read-only (with the write or read_only block, see
+// SetIndexBlock) and a copy of every primary shard must be on the same node.
+// When the index can't be shrunk, false is returned with the human-readable
+// reasons.
+func (h *Handler) CanShrink(ctx context.Context) (bool, []string, error) {
+	settings, err := h.getSettings(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	reasons := []string{}
+	if fmt.Sprint(settings["index.blocks.write"]) != "true" && fmt.Sprint(settings["index.blocks.read_only"]) != "true" {
+		reasons = append(reasons, "index is not read-only, set the write or read_only block")
+	}
+	shards, err := h.CatShards(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	nodes := map[string]bool{}
+	for _, s := range shards {
+		if !s.Primary {
+			continue
+		}
+		if s.Node == "" {
+			reasons = append(reasons, fmt.Sprintf("primary shard %d is not assigned", s.Shard))
+			continue
+		}
+		nodes[s.Node] = true
+	}
+	if len(nodes) > 1 {
+		reasons = append(reasons, fmt.Sprintf("primary shards are spread over %d nodes", len(nodes)))
+	}
+	if len(reasons) > 0 {
+		return false, reasons, nil
+	}
+	return true, nil, nil
+}
+
+// fielddataProperties returns the mapping properties of fields as text fields
+// with fielddata enabled. Dotted fields are mapped as sub-fields of objects. An
+// error is returned if a field is both listed and the parent of another one
+// (i.e.: "a" and "a.b"), as it can't be mapped as a text field and an object.
+func fielddataProperties(fields []string) (map[string]interface{}, error) {
+	props := map[string]interface{}{}
+	for _, f := range fields {
+		p := props
+		path := strings.Split(f, ".")
+		for i, name := range path[:len(path)-1] {
+			obj, ok := p[name].(map[string]interface{})
+			if !ok {
+				obj = map[string]interface{}{"properties": map[string]interface{}{}}
+				p[name] = obj
+			}
+			if p, ok = obj["properties"].(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("fielddata field %q conflicts with text field %q", f, strings.Join(path[:i+1], "."))
+			}
+		}
+		name := path[len(path)-1]
+		if obj, ok := p[name].(map[string]interface{}); ok && obj["properties"] != nil {
+			return nil, fmt.Errorf("fielddata field %q conflicts with its sub-fields", f)
+		}
+		p[name] = map[string]interface{}{"type": "text", "fielddata": true}
+	}
+	return props, nil
+}
+
+// EnableFielddata enables fielddata on the text field of the existing handler's
+// index. See FielddataFields for the memory implications.
+func (h *Handler) EnableFielddata(ctx context.Context, field string) error {
+	props, err := fielddataProperties([]string{field})
+	if err != nil {
+		return fmt.Errorf("enable fielddata error (index=%s, type=%s, field=%s): %v", h.index, h.typ, field, err)
+	}
+	body := map[string]interface{}{"properties": props}
+	_, err = h.client.PutMapping().Index(h.index).Type(h.typ).BodyJson(body).Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("enable fielddata error (index=%s, type=%s, field=%s): %v", h.index, h.typ, field, err)
+		}
+		return err
+	}
+	return nil
+}
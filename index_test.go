@@ -0,0 +1,362 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestEnsureIndex(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testensureindex")()
+	h := NewHandler(c, "testensureindex", "test", WithIndexSettings(map[string]interface{}{
+		"number_of_shards": 3,
+	}), WithReplicas(0))
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	// Calling it on an existing index is a no-op
+	assert.NoError(t, h.EnsureIndex(ctx))
+
+	res, err := c.PerformRequest(ctx, "GET", "/testensureindex/_settings", nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	settings := map[string]struct {
+		Settings struct {
+			Index struct {
+				Shards   string `json:"number_of_shards"`
+				Replicas string `json:"number_of_replicas"`
+			} `json:"index"`
+		} `json:"settings"`
+	}{}
+	if assert.NoError(t, json.Unmarshal(res.Body, &settings)) {
+		assert.Equal(t, "3", settings["testensureindex"].Settings.Index.Shards)
+		assert.Equal(t, "0", settings["testensureindex"].Settings.Index.Replicas)
+	}
+}
+
+func TestCreateFilteredAlias(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfilteredalias")()
+	h := NewHandler(c, "testfilteredalias", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tenant": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "tenant": "b"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "tenant": "a"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	fq, err := query.New("", `{tenant:"a"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, h.CreateFilteredAlias(ctx, "testfilteredalias-a", fq))
+
+	ha := NewHandler(c, "testfilteredalias-a", "test")
+	q, err := query.New("", "", "", nil)
+	if assert.NoError(t, err) {
+		l, err := ha.Find(ctx, q)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 2, l.Total)
+		}
+	}
+}
+
+// getIndexSetting returns the value of an index setting.
+func getIndexSetting(c *elastic.Client, index, name string) (interface{}, error) {
+	res, err := c.PerformRequest(context.TODO(), "GET", "/"+index+"/_settings", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]struct {
+		Settings struct {
+			Index map[string]interface{} `json:"index"`
+		} `json:"settings"`
+	}{}
+	if err := json.Unmarshal(res.Body, &settings); err != nil {
+		return nil, err
+	}
+	return settings[index].Settings.Index[name], nil
+}
+
+func TestSetRefreshInterval(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testrefreshinterval")()
+	h := NewHandler(c, "testrefreshinterval", "test")
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+
+	assert.NoError(t, h.SetRefreshInterval(ctx, "-1"))
+	v, err := getIndexSetting(c, "testrefreshinterval", "refresh_interval")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "-1", v)
+	}
+	assert.NoError(t, h.RestoreDefaultRefreshInterval(ctx))
+	v, err = getIndexSetting(c, "testrefreshinterval", "refresh_interval")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1s", v)
+	}
+}
+
+func TestShardsReplicasOptions(t *testing.T) {
+	h := NewHandler(nil, "index", "type", WithShards(3), WithReplicas(1))
+	assert.Equal(t, map[string]interface{}{"number_of_shards": 3, "number_of_replicas": 1}, h.IndexSettings)
+	h = NewHandler(nil, "index", "type", WithIndexSettings(map[string]interface{}{"refresh_interval": "30s"}), WithReplicas(0))
+	assert.Equal(t, map[string]interface{}{"refresh_interval": "30s", "number_of_replicas": 0}, h.IndexSettings)
+}
+
+func TestUpdateReplicas(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testupdatereplicas")()
+	h := NewHandler(c, "testupdatereplicas", "test", WithReplicas(0))
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	assert.NoError(t, h.UpdateReplicas(ctx, 2))
+	v, err := getIndexSetting(c, "testupdatereplicas", "number_of_replicas")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2", v)
+	}
+}
+
+func TestFielddataProperties(t *testing.T) {
+	fd := map[string]interface{}{"type": "text", "fielddata": true}
+	props, err := fielddataProperties([]string{"name", "author.name", "author.bio", "name"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"name": fd,
+		"author": map[string]interface{}{
+			"properties": map[string]interface{}{"name": fd, "bio": fd},
+		},
+	}, props)
+
+	// A field can't be both a text field and an object
+	_, err = fielddataProperties([]string{"a", "a.b"})
+	assert.EqualError(t, err, `fielddata field "a.b" conflicts with text field "a"`)
+	_, err = fielddataProperties([]string{"a.b.c", "a.b"})
+	assert.EqualError(t, err, `fielddata field "a.b" conflicts with its sub-fields`)
+	_, err = fielddataProperties([]string{"a.b", "a.b.c.d"})
+	assert.EqualError(t, err, `fielddata field "a.b.c.d" conflicts with text field "a.b"`)
+
+	// The conflict is reported before any request is sent
+	h := &Handler{index: "test", FielddataFields: []string{"a", "a.b"}}
+	assert.EqualError(t, h.EnsureIndex(context.Background()),
+		`ensure index error (index=test): fielddata field "a.b" conflicts with text field "a"`)
+}
+
+// getFieldMapping returns the mapping of a field of the test type.
+func getFieldMapping(c *elastic.Client, index, field string) (map[string]interface{}, error) {
+	res, err := c.PerformRequest(context.TODO(), "GET", "/"+index+"/_mapping/test", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	mappings := map[string]struct {
+		Mappings map[string]struct {
+			Properties map[string]map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}{}
+	if err := json.Unmarshal(res.Body, &mappings); err != nil {
+		return nil, err
+	}
+	return mappings[index].Mappings["test"].Properties[field], nil
+}
+
+func TestFielddata(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfielddata")()
+	h := NewHandler(c, "testfielddata", "test")
+	h.FielddataFields = []string{"title"}
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	m, err := getFieldMapping(c, "testfielddata", "title")
+	if assert.NoError(t, err) {
+		assert.Equal(t, true, m["fielddata"])
+	}
+
+	assert.NoError(t, h.EnableFielddata(ctx, "body"))
+	m, err = getFieldMapping(c, "testfielddata", "body")
+	if assert.NoError(t, err) {
+		assert.Equal(t, true, m["fielddata"])
+	}
+}
+
+func TestDateRollingPattern(t *testing.T) {
+	p := DateRollingPattern("logs", "2006.01.02")
+	updated := time.Date(2017, 1, 15, 23, 30, 0, 0, time.FixedZone("", -2*3600))
+	assert.Equal(t, "logs-2017.01.16", p(&resource.Item{Updated: updated}))
+	assert.Equal(t, "logs-"+time.Now().UTC().Format("2006.01.02"), p(&resource.Item{}))
+}
+
+func TestDateRollingIndices(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testrolling-2017.01.01")()
+	defer cleanup(c, "testrolling-2017.01.02")()
+	h := NewHandler(c, "testrolling-*", "test")
+	h.Refresh = "true"
+	h.IndexSelector = DateRollingPattern("testrolling", "2006.01.02")
+	day1 := time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)
+	day2 := time.Date(2017, 1, 2, 10, 0, 0, 0, time.UTC)
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Updated: day1, Payload: map[string]interface{}{"id": "1"}},
+		{ID: "2", ETag: "a", Updated: day2, Payload: map[string]interface{}{"id": "2"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", "", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Equal(t, 2, l.Total) {
+		// Update the item read from the store, stored in the day 1 index
+		for _, original := range l.Items {
+			if original.ID != "1" {
+				continue
+			}
+			assert.Equal(t, day1, original.Updated.UTC())
+			item := &resource.Item{ID: "1", ETag: "b", Updated: day2, Payload: map[string]interface{}{"id": "1", "name": "a"}}
+			assert.NoError(t, h.Update(ctx, item, original))
+		}
+	}
+	n, err := c.Count("testrolling-2017.01.01").Do(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), n)
+	}
+}
+
+func TestIndexBlockSetting(t *testing.T) {
+	s, err := indexBlockSetting("write")
+	assert.NoError(t, err)
+	assert.Equal(t, "blocks.write", s)
+	s, err = indexBlockSetting("metadata_write")
+	assert.NoError(t, err)
+	assert.Equal(t, "blocks.metadata", s)
+	_, err = indexBlockSetting("all")
+	assert.EqualError(t, err, `invalid index block: "all"`)
+}
+
+func TestIndexBlock(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testindexblock")()
+	h := NewHandler(c, "testindexblock", "test")
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1"}}
+
+	assert.NoError(t, h.SetIndexBlock(ctx, "write"))
+	assert.Error(t, h.Insert(ctx, []*resource.Item{item}))
+	assert.NoError(t, h.ClearIndexBlock(ctx, "write"))
+	assert.NoError(t, h.Insert(ctx, []*resource.Item{item}))
+}
+
+func TestNormalizeKeywords(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testnormalizekeywords")()
+	h := NewHandler(c, "testnormalizekeywords", "test")
+	h.Refresh = "true"
+	h.NormalizeKeywords = true
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	assert.NoError(t, h.EnsureNormalizerSettings(ctx))
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "Alice"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "Bob"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{name:"alice"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "1", l.Items[0].ID)
+	}
+}
+
+func TestCanShrink(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testcanshrink")()
+	h := NewHandler(c, "testcanshrink", "test", WithShards(2), WithReplicas(0))
+	ctx := context.TODO()
+
+	_, _, err = h.CanShrink(ctx)
+	assert.Equal(t, resource.ErrNotFound, err)
+
+	assert.NoError(t, h.EnsureIndex(ctx))
+	ok, reasons, err := h.CanShrink(ctx)
+	if assert.NoError(t, err) {
+		assert.False(t, ok)
+		assert.Equal(t, []string{"index is not read-only, set the write or read_only block"}, reasons)
+	}
+
+	// The test cluster has a single node holding all the primary shards
+	assert.NoError(t, h.SetIndexBlock(ctx, "write"))
+	ok, reasons, err = h.CanShrink(ctx)
+	if assert.NoError(t, err) {
+		assert.True(t, ok)
+		assert.Nil(t, reasons)
+	}
+}
@@ -0,0 +1,100 @@
+// Package mask provides a REST Layer response formatter masking the payload
+// fields of the items sent in API responses (i.e.: to hide personal data from
+// API consumers).
+//
+// Masking is applied when the response is built and not by the storage
+// handler, as REST Layer builds updated items (PUT or PATCH) from the stored
+// item it reads: the masked values would otherwise be written back.
+package mask
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+)
+
+// FieldMasker masks the values of the payload fields of the items.
+type FieldMasker interface {
+	// Mask returns the value to return for field in place of value.
+	Mask(field string, value interface{}) interface{}
+}
+
+// Redacted is the value of the fields masked by RedactMasker.
+const Redacted = "[REDACTED]"
+
+type redactMasker map[string]bool
+
+// RedactMasker returns a FieldMasker replacing the value of the given
+// top-level fields by Redacted.
+func RedactMasker(fields []string) FieldMasker {
+	m := redactMasker{}
+	for _, f := range fields {
+		m[f] = true
+	}
+	return m
+}
+
+// Mask implements FieldMasker interface.
+func (m redactMasker) Mask(field string, value interface{}) interface{} {
+	if m[field] {
+		return Redacted
+	}
+	return value
+}
+
+// ResponseFormatter is a rest.ResponseFormatter masking the payload fields of
+// the items sent in responses with Masker. It is set as the ResponseFormatter
+// of the REST Layer rest.Handler. Fields are masked by their name in the
+// response, after projection aliasing.
+type ResponseFormatter struct {
+	// Formatter formats the responses once masked. If nil,
+	// rest.DefaultResponseFormatter is used.
+	Formatter rest.ResponseFormatter
+	// Masker masks the payload fields of the items.
+	Masker FieldMasker
+}
+
+func (f ResponseFormatter) formatter() rest.ResponseFormatter {
+	if f.Formatter == nil {
+		return rest.DefaultResponseFormatter{}
+	}
+	return f.Formatter
+}
+
+// mask returns a copy of i with its payload masked.
+func (f ResponseFormatter) mask(i *resource.Item) *resource.Item {
+	if i == nil || f.Masker == nil {
+		return i
+	}
+	mi := *i
+	mi.Payload = make(map[string]interface{}, len(i.Payload))
+	for k, v := range i.Payload {
+		mi.Payload[k] = f.Masker.Mask(k, v)
+	}
+	return &mi
+}
+
+// FormatItem implements rest.ResponseFormatter interface.
+func (f ResponseFormatter) FormatItem(ctx context.Context, headers http.Header, i *resource.Item, skipBody bool) (context.Context, interface{}) {
+	return f.formatter().FormatItem(ctx, headers, f.mask(i), skipBody)
+}
+
+// FormatList implements rest.ResponseFormatter interface.
+func (f ResponseFormatter) FormatList(ctx context.Context, headers http.Header, l *resource.ItemList, skipBody bool) (context.Context, interface{}) {
+	if l != nil && f.Masker != nil {
+		ml := *l
+		ml.Items = make([]*resource.Item, len(l.Items))
+		for i, item := range l.Items {
+			ml.Items[i] = f.mask(item)
+		}
+		l = &ml
+	}
+	return f.formatter().FormatList(ctx, headers, l, skipBody)
+}
+
+// FormatError implements rest.ResponseFormatter interface.
+func (f ResponseFormatter) FormatError(ctx context.Context, headers http.Header, err error, skipBody bool) (context.Context, interface{}) {
+	return f.formatter().FormatError(ctx, headers, err, skipBody)
+}
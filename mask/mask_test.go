@@ -0,0 +1,92 @@
+package mask
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	es "github.com/rs/rest-layer-es"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+	"github.com/rs/rest-layer/schema"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestRedactMasker(t *testing.T) {
+	m := RedactMasker([]string{"ssn"})
+	assert.Equal(t, Redacted, m.Mask("ssn", "123"))
+	assert.Equal(t, "bob", m.Mask("name", "bob"))
+}
+
+func TestResponseFormatter(t *testing.T) {
+	f := ResponseFormatter{Masker: RedactMasker([]string{"ssn"})}
+	ctx := context.Background()
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "bob", "ssn": "123"}}
+
+	headers := http.Header{}
+	_, body := f.FormatItem(ctx, headers, item, false)
+	assert.Equal(t, map[string]interface{}{"id": "1", "name": "bob", "ssn": Redacted}, body)
+	assert.Equal(t, `W/"a"`, headers.Get("Etag"))
+	// The item itself is left untouched
+	assert.Equal(t, "123", item.Payload["ssn"])
+
+	_, body = f.FormatList(ctx, http.Header{}, &resource.ItemList{Total: 1, Items: []*resource.Item{item}}, false)
+	assert.Equal(t, []map[string]interface{}{{"id": "1", "name": "bob", "ssn": Redacted, "_etag": "a"}}, body)
+	assert.Equal(t, "123", item.Payload["ssn"])
+}
+
+func TestResponseFormatterUpdate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.TODO()
+	defer c.DeleteIndex("testmaskupdate").Do(ctx)
+	h := es.NewHandler(c, "testmaskupdate", "test")
+	h.Refresh = "true"
+	assert.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "bob", "ssn": "123"}},
+	}))
+
+	index := resource.NewIndex()
+	index.Bind("users", schema.Schema{Fields: schema.Fields{
+		"id":   {Required: true, ReadOnly: true, Filterable: true, Sortable: true, Validator: &schema.String{}},
+		"name": {Validator: &schema.String{}},
+		"ssn":  {Validator: &schema.String{}},
+	}}, h, resource.DefaultConf)
+	api, err := rest.NewHandler(index)
+	if !assert.NoError(t, err) {
+		return
+	}
+	api.ResponseFormatter = ResponseFormatter{Masker: RedactMasker([]string{"ssn"})}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("PATCH", ts.URL+"/users/1", strings.NewReader(`{"name":"alice"}`))
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	body := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]interface{}{"id": "1", "name": "alice", "ssn": Redacted}, body)
+
+	// The stored value is kept
+	doc, err := c.Get().Index("testmaskupdate").Type("test").Id("1").Do(ctx)
+	if assert.NoError(t, err) {
+		d := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(*doc.Source, &d))
+		assert.Equal(t, "alice", d["name"])
+		assert.Equal(t, "123", d["ssn"])
+	}
+}
@@ -0,0 +1,64 @@
+package es
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// MultiFind performs the Find of each of queries in a single ES multi search
+// request and returns their results in queries order. Precompiled queries are
+// not used by MultiFind. If one of the searches fails, an error is returned.
+func (h *Handler) MultiFind(ctx context.Context, queries []*query.Query) ([]*resource.ItemList, error) {
+	if len(queries) == 0 {
+		return []*resource.ItemList{}, nil
+	}
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	ms := h.reader().MultiSearch()
+	for i, q := range queries {
+		q = h.filterQuery(ctx, q)
+		qry, err := h.getQuery(q)
+		if err != nil {
+			return nil, fmt.Errorf("multi find query #%d translation error (index=%s, type=%s): %v", i+1, h.index, h.typ, err)
+		}
+		src, err := h.newSearchSource(ctx, q, qry)
+		if err != nil {
+			return nil, err
+		}
+		r := elastic.NewSearchRequest().Index(h.index).Type(h.searchTypes(q)...).SearchSource(src)
+		if rt := h.searchRouting(ctx, q); rt != "" {
+			r.Routing(rt)
+		}
+		if p := h.preference(ctx); p != "" {
+			r.Preference(p)
+		}
+		if qc := GetESOptions(ctx).QueryCache; qc != nil {
+			r.RequestCache(*qc)
+		}
+		ms.Add(r)
+	}
+	res, err := ms.Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("multi find error (index=%s, type=%s): %v", h.index, h.typ, err)
+		}
+		return nil, err
+	}
+	if len(res.Responses) != len(queries) {
+		return nil, fmt.Errorf("multi find error (index=%s, type=%s): got %d responses for %d queries", h.index, h.typ, len(res.Responses), len(queries))
+	}
+	lists := make([]*resource.ItemList, len(queries))
+	for i, r := range res.Responses {
+		if r.Error != nil {
+			return nil, fmt.Errorf("multi find query #%d error (index=%s, type=%s): %s: %s", i+1, h.index, h.typ, r.Error.Type, r.Error.Reason)
+		}
+		if lists[i], err = buildItemList(r); err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
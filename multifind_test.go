@@ -0,0 +1,56 @@
+package es
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestMultiFind(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testmultifind")()
+	h := NewHandler(c, "testmultifind", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "b"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	l, err := h.MultiFind(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, l, 0)
+
+	qa, err := query.New("", `{name:"a"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	qb, err := query.New("", `{name:"b"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	qc, err := query.New("", `{name:"c"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err = h.MultiFind(ctx, []*query.Query{qb, qa, qc})
+	if assert.NoError(t, err) && assert.Len(t, l, 3) {
+		assert.Equal(t, 2, l[0].Total)
+		if assert.Equal(t, 1, l[1].Total) {
+			assert.Equal(t, "1", l[1].Items[0].ID)
+		}
+		assert.Equal(t, 0, l[2].Total)
+	}
+}
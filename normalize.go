@@ -0,0 +1,116 @@
+package es
+
+import "github.com/rs/rest-layer/schema/query"
+
+// NormalizePredicate returns p in a canonical form, so logically equivalent
+// predicates are translated to the same ES query:
+//
+//  - nested $and in $and and $or in $or are flattened,
+//  - $and and $or with a single expression are replaced by this expression,
+//  - always true expressions ($and without expression, $nin without value)
+//    are removed from $and and make $or always true,
+//  - always false expressions ($or without expression, $in without value)
+//    are removed from $or and make $and always false,
+//  - the expressions wrapped by MinimumShouldMatchOr, Boosted and
+//    NamedExpression are normalized, a MinimumShouldMatchOr lower than 2
+//    being normalized as a plain $or.
+//
+// Negations are expressed by dedicated operators ($ne, $nin, $exists: false)
+// in REST Layer predicates, so there is no double negation to eliminate. An
+// always false predicate is returned as a predicate holding an empty $or. The
+// p predicate is not modified.
+func NormalizePredicate(p query.Predicate) query.Predicate {
+	np := make(query.Predicate, 0, len(p))
+	for _, e := range p {
+		ne := normalizeExpression(e)
+		if isAlwaysTrue(ne) {
+			continue
+		}
+		if isAlwaysFalse(ne) {
+			return query.Predicate{ne}
+		}
+		np = append(np, ne)
+	}
+	return np
+}
+
+// isAlwaysTrue returns true for the canonical always true expression, an empty
+// $and.
+func isAlwaysTrue(e query.Expression) bool {
+	and, ok := e.(*query.And)
+	return ok && len(*and) == 0
+}
+
+// isAlwaysFalse returns true for the canonical always false expression, an
+// empty $or.
+func isAlwaysFalse(e query.Expression) bool {
+	or, ok := e.(*query.Or)
+	return ok && len(*or) == 0
+}
+
+// normalizeExpression returns e in canonical form, see NormalizePredicate.
+func normalizeExpression(e query.Expression) query.Expression {
+	switch t := e.(type) {
+	case *query.And:
+		and := query.And{}
+		for _, subExp := range *t {
+			se := normalizeExpression(subExp)
+			if isAlwaysFalse(se) {
+				return se
+			}
+			if sub, ok := se.(*query.And); ok {
+				// Also drops always true expressions
+				and = append(and, *sub...)
+				continue
+			}
+			and = append(and, se)
+		}
+		if len(and) == 1 {
+			return and[0]
+		}
+		return &and
+	case *query.Or:
+		or := query.Or{}
+		for _, subExp := range *t {
+			se := normalizeExpression(subExp)
+			if isAlwaysTrue(se) {
+				return se
+			}
+			if sub, ok := se.(*query.Or); ok {
+				// Also drops always false expressions
+				or = append(or, *sub...)
+				continue
+			}
+			or = append(or, se)
+		}
+		if len(or) == 1 {
+			return or[0]
+		}
+		return &or
+	case *query.In:
+		if len(t.Values) == 0 {
+			return &query.Or{}
+		}
+	case *query.NotIn:
+		if len(t.Values) == 0 {
+			return &query.And{}
+		}
+	case *MinimumShouldMatchOr:
+		if t.MinimumShouldMatch < 2 {
+			or := t.Or
+			return normalizeExpression(&or)
+		}
+		// Sub-expressions are counted by the minimum should match, so they
+		// are normalized but not flattened nor removed
+		or := make(query.Or, len(t.Or))
+		for i, subExp := range t.Or {
+			or[i] = normalizeExpression(subExp)
+		}
+		return &MinimumShouldMatchOr{Or: or, MinimumShouldMatch: t.MinimumShouldMatch}
+	case *Boosted:
+		return &Boosted{Expression: normalizeExpression(t.Expression), Boost: t.Boost}
+	case *NamedExpression:
+		return &NamedExpression{Name: t.Name, Expr: normalizeExpression(t.Expr)}
+	}
+	return e
+}
@@ -0,0 +1,91 @@
+package es
+
+import (
+	"testing"
+
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePredicate(t *testing.T) {
+	a := &query.Equal{Field: "a", Value: 1}
+	b := &query.Equal{Field: "b", Value: 1}
+	c := &query.Equal{Field: "c", Value: 1}
+	cases := []struct {
+		name string
+		p    query.Predicate
+		want query.Predicate
+	}{
+		{"empty",
+			query.Predicate{},
+			query.Predicate{}},
+		{"unchanged",
+			query.Predicate{a, &query.Or{b, c}},
+			query.Predicate{a, &query.Or{b, c}}},
+		{"flatten and",
+			query.Predicate{&query.And{a, &query.And{b, c}}},
+			query.Predicate{&query.And{a, b, c}}},
+		{"flatten or",
+			query.Predicate{&query.Or{&query.Or{a, b}, c}},
+			query.Predicate{&query.Or{a, b, c}}},
+		{"no flatten or in and",
+			query.Predicate{&query.And{a, &query.Or{b, c}}},
+			query.Predicate{&query.And{a, &query.Or{b, c}}}},
+		{"single and",
+			query.Predicate{&query.And{a}},
+			query.Predicate{a}},
+		{"single or",
+			query.Predicate{&query.Or{&query.And{a}}},
+			query.Predicate{a}},
+		{"always true removed",
+			query.Predicate{a, &query.And{}, &query.NotIn{Field: "b"}},
+			query.Predicate{a}},
+		{"always true in and",
+			query.Predicate{&query.And{a, &query.NotIn{Field: "b"}, c}},
+			query.Predicate{&query.And{a, c}}},
+		{"always true or",
+			query.Predicate{b, &query.Or{a, &query.NotIn{Field: "b"}}},
+			query.Predicate{b}},
+		{"always false predicate",
+			query.Predicate{a, &query.In{Field: "b"}},
+			query.Predicate{&query.Or{}}},
+		{"always false in or",
+			query.Predicate{&query.Or{a, &query.In{Field: "b"}, c}},
+			query.Predicate{&query.Or{a, c}}},
+		{"always false and",
+			query.Predicate{&query.And{a, &query.Or{}}},
+			query.Predicate{&query.Or{}}},
+		{"boosted",
+			query.Predicate{&Boosted{Expression: &query.And{a}, Boost: 2}},
+			query.Predicate{&Boosted{Expression: a, Boost: 2}}},
+		{"named",
+			query.Predicate{&NamedExpression{Name: "n", Expr: &query.And{a, &query.And{b, c}}}},
+			query.Predicate{&NamedExpression{Name: "n", Expr: &query.And{a, b, c}}}},
+		{"minimum should match",
+			query.Predicate{&MinimumShouldMatchOr{Or: query.Or{&query.And{a}, &query.Or{b, c}, &query.In{Field: "b"}}, MinimumShouldMatch: 2}},
+			query.Predicate{&MinimumShouldMatchOr{Or: query.Or{a, &query.Or{b, c}, &query.Or{}}, MinimumShouldMatch: 2}}},
+		{"minimum should match one",
+			query.Predicate{&MinimumShouldMatchOr{Or: query.Or{&query.Or{a, b}, &query.And{c}}, MinimumShouldMatch: 1}},
+			query.Predicate{&query.Or{a, b, c}}},
+		{"minimum should match always false",
+			query.Predicate{a, &MinimumShouldMatchOr{Or: query.Or{&query.In{Field: "b"}}}},
+			query.Predicate{&query.Or{}}},
+		{"nested wrappers",
+			query.Predicate{&Boosted{Expression: &NamedExpression{Name: "n", Expr: &query.Or{&query.Or{a}}}, Boost: 2}},
+			query.Predicate{&Boosted{Expression: &NamedExpression{Name: "n", Expr: a}, Boost: 2}}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, NormalizePredicate(tc.p))
+		})
+	}
+}
+
+func TestNormalizePredicateNoModification(t *testing.T) {
+	a := &query.Equal{Field: "a", Value: 1}
+	b := &query.Equal{Field: "b", Value: 1}
+	p := query.Predicate{&query.And{a, &query.And{b}}}
+	NormalizePredicate(p)
+	assert.Equal(t, query.Predicate{&query.And{a, &query.And{b}}}, p)
+}
@@ -0,0 +1,62 @@
+package es
+
+import "gopkg.in/olivere/elastic.v5"
+
+// HandlerOption configures optional behaviors of a Handler created with
+// NewHandler.
+type HandlerOption func(h *Handler)
+
+// WithFieldTypeProvider sets the FieldTypeProvider used to translate queries
+// and sorts. When no provider is set, the .keyword sub-field is used for
+// exact match and sort operations and never for range operations.
+func WithFieldTypeProvider(p FieldTypeProvider) HandlerOption {
+	return func(h *Handler) {
+		h.fieldTypes = p
+	}
+}
+
+// WithReadClient sets a client used for read operations (Find, MultiGet and
+// their variants) while the handler's client is used for write operations
+// (Insert, Update, Delete...) and ETag checks. This allows reads to be served
+// by a different cluster than writes, as long as it holds the same data.
+func WithReadClient(c *elastic.Client) HandlerOption {
+	return func(h *Handler) {
+		h.readClient = c
+	}
+}
+
+// WithVersionCheck makes EnsureIndex fail if the version of the ES cluster is
+// lower than minVersion (i.e.: "5.3.0"), see RequireVersion. NewHandler not
+// performing any request, the check is deferred to EnsureIndex, which is meant
+// to be called at startup.
+func WithVersionCheck(minVersion string) HandlerOption {
+	return func(h *Handler) {
+		h.minVersion = minVersion
+	}
+}
+
+// WithIndexSettings adds settings used to create the index with EnsureIndex,
+// like number_of_shards, number_of_replicas, refresh_interval or analysis.
+func WithIndexSettings(settings map[string]interface{}) HandlerOption {
+	return func(h *Handler) {
+		for name, value := range settings {
+			h.setIndexSetting(name, value)
+		}
+	}
+}
+
+// WithShards sets the number of primary shards of the index created by
+// EnsureIndex.
+func WithShards(n int) HandlerOption {
+	return func(h *Handler) {
+		h.setIndexSetting("number_of_shards", n)
+	}
+}
+
+// WithReplicas sets the number of replicas of each primary shard of the index
+// created by EnsureIndex (i.e.: 0 for single node development environments).
+func WithReplicas(n int) HandlerOption {
+	return func(h *Handler) {
+		h.setIndexSetting("number_of_replicas", n)
+	}
+}
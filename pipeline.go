@@ -0,0 +1,51 @@
+package es
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// geoIPPipeline returns the ingest pipeline definition with a geoip processor
+// for each of the GeoIPFields, in source field order.
+func (h *Handler) geoIPPipeline() map[string]interface{} {
+	fields := make([]string, 0, len(h.GeoIPFields))
+	for f := range h.GeoIPFields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	processors := make([]interface{}, len(fields))
+	for i, f := range fields {
+		processors[i] = map[string]interface{}{
+			"geoip": map[string]interface{}{
+				"field":          f,
+				"target_field":   h.GeoIPFields[f],
+				"ignore_missing": true,
+			},
+		}
+	}
+	return map[string]interface{}{
+		"description": fmt.Sprintf("GeoIP enrichment of %s/%s documents", h.index, h.typ),
+		"processors":  processors,
+	}
+}
+
+// EnsureGeoIPPipeline creates or replaces the <index>-geoip ingest pipeline
+// adding the geo location of the IP addresses of the GeoIPFields source fields
+// to their target fields, and sets it as the handler's Pipeline. Items
+// without IP address are stored unchanged. The ingest-geoip plugin must be
+// installed on the ES ingest nodes.
+func (h *Handler) EnsureGeoIPPipeline(ctx context.Context) error {
+	if len(h.GeoIPFields) == 0 {
+		return fmt.Errorf("geoip pipeline error (index=%s): no GeoIPFields", h.index)
+	}
+	name := h.index + "-geoip"
+	if _, err := h.client.IngestPutPipeline(name).BodyJson(h.geoIPPipeline()).Do(ctx); err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("geoip pipeline error (index=%s, pipeline=%s): %v", h.index, name, err)
+		}
+		return err
+	}
+	h.Pipeline = name
+	return nil
+}
@@ -0,0 +1,59 @@
+package es
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestGeoIPPipeline(t *testing.T) {
+	h := &Handler{index: "index", typ: "type", GeoIPFields: map[string]string{"ip": "geo", "client.ip": "client.geo"}}
+	assert.Equal(t, map[string]interface{}{
+		"description": "GeoIP enrichment of index/type documents",
+		"processors": []interface{}{
+			map[string]interface{}{"geoip": map[string]interface{}{"field": "client.ip", "target_field": "client.geo", "ignore_missing": true}},
+			map[string]interface{}{"geoip": map[string]interface{}{"field": "ip", "target_field": "geo", "ignore_missing": true}},
+		},
+	}, h.geoIPPipeline())
+}
+
+func TestEnsureGeoIPPipeline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testgeoip")()
+	h := NewHandler(c, "testgeoip", "test")
+	h.Refresh = "true"
+	ctx := context.TODO()
+	assert.Error(t, h.EnsureGeoIPPipeline(ctx))
+
+	h.GeoIPFields = map[string]string{"ip": "geo"}
+	if !assert.NoError(t, h.EnsureGeoIPPipeline(ctx)) {
+		return
+	}
+	defer c.IngestDeletePipeline("testgeoip-geoip").Do(ctx)
+	assert.Equal(t, "testgeoip-geoip", h.Pipeline)
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "ip": "8.8.8.8"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	l, err := h.MultiGet(ctx, []interface{}{"1", "2"})
+	if assert.NoError(t, err) && assert.Len(t, l, 2) {
+		for _, item := range l {
+			if item.ID == "1" {
+				assert.NotNil(t, item.Payload["geo"])
+			} else {
+				assert.Nil(t, item.Payload["geo"])
+			}
+		}
+	}
+}
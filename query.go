@@ -1,7 +1,12 @@
 package es
 
 import (
+	"fmt"
+	"math"
+	"strings"
+
 	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
 	"github.com/rs/rest-layer/schema/query"
 	"gopkg.in/olivere/elastic.v5"
 )
@@ -9,22 +14,71 @@ import (
 // getField translate a schema field into a ES field:
 //
 //  - id -> _id with in order to tape on the ES _id key
+//  - _etag -> _etag as etags are matched as a whole, with no .keyword suffix
 //  - keyword=true -> appends .keyword to the field name
-func getField(f string, keyword bool) string {
+//
+// When a FieldTypeProvider is configured, the keyword argument is ignored and
+// the provider decides if the .keyword sub-field must be used.
+func (h *Handler) getField(f string, keyword bool) string {
 	if f == "id" {
 		return "_id"
-	} else if keyword {
+	}
+	if f == etagField {
+		return f
+	}
+	if h.fieldTypes != nil {
+		keyword = h.fieldTypes.IsKeyword(f)
+	}
+	if keyword {
 		return f + ".keyword"
 	}
 	return f
 }
 
-// getQuery transform a resource.Lookup into a ES query
-func getQuery(q *query.Query) (elastic.Query, error) {
-	qs, err := translatePredicate(q.Predicate)
+// nestedPath returns the path of the nested object containing f according to
+// the configured FieldTypeProvider or NestedPaths, or an empty string if f is
+// not part of a nested object.
+func (h *Handler) nestedPath(f string) string {
+	if h.fieldTypes != nil {
+		if path := h.fieldTypes.IsNested(f); path != "" {
+			return path
+		}
+	}
+	path := ""
+	for _, p := range h.NestedPaths {
+		// Use the deepest path if nested objects are nested in each other
+		if strings.HasPrefix(f, p+".") && len(p) > len(path) {
+			path = p
+		}
+	}
+	return path
+}
+
+// wrapNested wraps q into a nested query if f is part of a nested object. The
+// full field path is kept in q as required by ES nested queries.
+func (h *Handler) wrapNested(f string, q elastic.Query) elastic.Query {
+	if path := h.nestedPath(f); path != "" {
+		return elastic.NewNestedQuery(path, q)
+	}
+	return q
+}
+
+// getQuery transform a resource.Lookup into a ES query.
+//
+// As REST Layer predicates are filters, with no notion of relevance, the
+// translated queries are executed in filter context (inside bool.filter) so ES
+// can skip scoring and cache them, unless ForceQueryContext is set.
+func (h *Handler) getQuery(q *query.Query) (elastic.Query, error) {
+	qs, err := h.translatePredicate(NormalizePredicate(q.Predicate))
 	if err != nil {
 		return nil, err
 	}
+	if !h.ForceQueryContext {
+		if len(qs) == 0 {
+			return nil, nil
+		}
+		return elastic.NewBoolQuery().Filter(qs...), nil
+	}
 	switch len(qs) {
 	case 0:
 		return nil, nil
@@ -39,29 +93,30 @@ func getQuery(q *query.Query) (elastic.Query, error) {
 }
 
 // getSort transform a resource.Lookup into an ES sort list.
-func getSort(q *query.Query) []elastic.Sorter {
+func (h *Handler) getSort(q *query.Query) []elastic.Sorter {
 	if len(q.Sort) == 0 {
 		return nil
 	}
 	s := make([]elastic.Sorter, len(q.Sort))
 	for i, sort := range q.Sort {
-		if sort.Reversed {
-			s[i] = elastic.NewFieldSort(getField(sort.Name, true)).Desc()
+		// Invert the order of fields sorted in reverse order by default
+		if sort.Reversed != h.SortDefaults[sort.Name] {
+			s[i] = elastic.NewFieldSort(h.getField(sort.Name, true)).Desc()
 		} else {
-			s[i] = elastic.NewFieldSort(getField(sort.Name, true)).Asc()
+			s[i] = elastic.NewFieldSort(h.getField(sort.Name, true)).Asc()
 		}
 	}
 	return s
 }
 
-func translatePredicate(q query.Predicate) ([]elastic.Query, error) {
+func (h *Handler) translatePredicate(q query.Predicate) ([]elastic.Query, error) {
 	qs := []elastic.Query{}
 	for _, exp := range q {
 		switch t := exp.(type) {
 		case *query.And:
 			and := elastic.NewBoolQuery()
 			for _, subExp := range *t {
-				sq, err := translatePredicate(query.Predicate{subExp})
+				sq, err := h.translatePredicate(query.Predicate{subExp})
 				if err != nil {
 					return nil, err
 				}
@@ -69,42 +124,258 @@ func translatePredicate(q query.Predicate) ([]elastic.Query, error) {
 			}
 			qs = append(qs, and)
 		case *query.Or:
-			or := elastic.NewBoolQuery()
-			for _, subExp := range *t {
-				sq, err := translatePredicate(query.Predicate{subExp})
-				if err != nil {
-					return nil, err
-				}
-				or.Should(sq...)
+			if len(*t) == 0 {
+				// An empty or matches nothing while an empty bool query
+				// matches everything
+				qs = append(qs, elastic.NewBoolQuery().MustNot(elastic.NewMatchAllQuery()))
+				continue
+			}
+			or, err := h.translateOr(*t)
+			if err != nil {
+				return nil, err
+			}
+			qs = append(qs, or)
+		case *MinimumShouldMatchOr:
+			or, err := h.translateOr(t.Or)
+			if err != nil {
+				return nil, err
+			}
+			if t.MinimumShouldMatch > 1 {
+				or.MinimumNumberShouldMatch(t.MinimumShouldMatch)
 			}
 			qs = append(qs, or)
 		case *query.In:
-			qs = append(qs, elastic.NewTermsQuery(getField(t.Field, true), valuesToInterface(t.Values)...))
+			q := elastic.NewTermsQuery(h.getField(t.Field, true), valuesToInterface(t.Values)...)
+			qs = append(qs, h.wrapNested(t.Field, h.leaf(q)))
 		case *query.NotIn:
 			b := elastic.NewBoolQuery()
-			b.MustNot(elastic.NewTermsQuery(getField(t.Field, true), valuesToInterface(t.Values)...))
+			q := elastic.NewTermsQuery(h.getField(t.Field, true), valuesToInterface(t.Values)...)
+			b.MustNot(h.wrapNested(t.Field, h.leaf(q)))
 			qs = append(qs, b)
 		case *query.Equal:
-			qs = append(qs, elastic.NewTermQuery(getField(t.Field, true), t.Value))
+			q := elastic.NewTermQuery(h.getField(t.Field, true), t.Value)
+			qs = append(qs, h.wrapNested(t.Field, h.leaf(q)))
 		case *query.NotEqual:
 			b := elastic.NewBoolQuery()
-			b.MustNot(elastic.NewTermQuery(getField(t.Field, true), t.Value))
+			q := elastic.NewTermQuery(h.getField(t.Field, true), t.Value)
+			b.MustNot(h.wrapNested(t.Field, h.leaf(q)))
 			qs = append(qs, b)
 		case *query.GreaterThan:
-			r := elastic.NewRangeQuery(getField(t.Field, false)).Gt(t.Value)
-			qs = append(qs, r)
+			r := elastic.NewRangeQuery(h.getField(t.Field, false)).Gt(h.rangeValue(t.Field, t.Value, math.Floor))
+			qs = append(qs, h.wrapNested(t.Field, h.leaf(r)))
 		case *query.GreaterOrEqual:
-			r := elastic.NewRangeQuery(getField(t.Field, false)).Gte(t.Value)
-			qs = append(qs, r)
+			r := elastic.NewRangeQuery(h.getField(t.Field, false)).Gte(h.rangeValue(t.Field, t.Value, math.Ceil))
+			qs = append(qs, h.wrapNested(t.Field, h.leaf(r)))
 		case *query.LowerThan:
-			r := elastic.NewRangeQuery(getField(t.Field, false)).Lt(t.Value)
-			qs = append(qs, r)
+			r := elastic.NewRangeQuery(h.getField(t.Field, false)).Lt(h.rangeValue(t.Field, t.Value, math.Ceil))
+			qs = append(qs, h.wrapNested(t.Field, h.leaf(r)))
 		case *query.LowerOrEqual:
-			r := elastic.NewRangeQuery(getField(t.Field, false)).Lte(t.Value)
-			qs = append(qs, r)
+			r := elastic.NewRangeQuery(h.getField(t.Field, false)).Lte(h.rangeValue(t.Field, t.Value, math.Floor))
+			qs = append(qs, h.wrapNested(t.Field, h.leaf(r)))
+		case *query.Regex:
+			re, err := luceneRegexp(t.Value.String())
+			if err != nil {
+				return nil, resource.ErrNotImplemented
+			}
+			q := h.wrapNested(t.Field, h.leaf(elastic.NewRegexpQuery(h.getField(t.Field, true), re)))
+			if t.Negated {
+				q = elastic.NewBoolQuery().MustNot(q)
+			}
+			qs = append(qs, q)
+		case *GeoPolygon:
+			q := elastic.NewGeoPolygonQuery(h.getField(t.Field, false))
+			for _, pt := range t.Points {
+				q.AddPoint(pt.Lat, pt.Lon)
+			}
+			qs = append(qs, h.wrapNested(t.Field, h.leaf(q)))
+		case *GeoShape:
+			q, err := h.geoShapeQuery(t)
+			if err != nil {
+				return nil, err
+			}
+			qs = append(qs, h.wrapNested(t.Field, h.leaf(q)))
+		case *Boosted:
+			sq, err := h.translatePredicate(query.Predicate{t.Expression})
+			if err != nil {
+				return nil, err
+			}
+			for _, q := range sq {
+				qs = append(qs, boost(q, t.Boost))
+			}
+		case *NamedExpression:
+			sq, err := h.translatePredicate(query.Predicate{t.Expr})
+			if err != nil {
+				return nil, err
+			}
+			for _, q := range sq {
+				qs = append(qs, name(q, t.Name))
+			}
 		default:
 			return nil, resource.ErrNotImplemented
 		}
 	}
 	return qs, nil
 }
+
+// leaf returns the leaf query q named after QueryName if set.
+func (h *Handler) leaf(q elastic.Query) elastic.Query {
+	if h.QueryName == "" {
+		return q
+	}
+	return name(q, h.QueryName)
+}
+
+// rangeValue returns the value v of a range query on field f. If f is listed
+// in IntegerFields, v is converted to an int64 using round so the range
+// matches the same integers: a fractional bound is rounded up for $gte and $lt
+// ({$lt: 1.5} is {$lt: 2}) and down for $gt and $lte ({$gt: 1.5} is {$gt: 1}).
+func (h *Handler) rangeValue(f string, v query.Value, round func(float64) float64) interface{} {
+	if fv, ok := v.(float64); ok {
+		for _, intf := range h.IntegerFields {
+			if intf == f {
+				return int64(round(fv))
+			}
+		}
+	}
+	return v
+}
+
+// translateOr translates the or expressions into should clauses of a bool
+// query.
+func (h *Handler) translateOr(or query.Or) (*elastic.BoolQuery, error) {
+	b := elastic.NewBoolQuery()
+	for _, subExp := range or {
+		sq, err := h.translatePredicate(query.Predicate{subExp})
+		if err != nil {
+			return nil, err
+		}
+		b.Should(sq...)
+	}
+	return b, nil
+}
+
+// MinimumShouldMatchOr is a query expression matching items matching at least
+// MinimumShouldMatch of the Or expressions. A MinimumShouldMatch lower than 2
+// behaves like a plain query.Or.
+type MinimumShouldMatchOr struct {
+	Or                 query.Or
+	MinimumShouldMatch int
+}
+
+// Match implements query.Expression interface.
+func (o MinimumShouldMatchOr) Match(payload map[string]interface{}) bool {
+	min := o.MinimumShouldMatch
+	if min < 1 {
+		min = 1
+	}
+	matches := 0
+	for _, exp := range o.Or {
+		if exp.Match(payload) {
+			if matches++; matches >= min {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Prepare implements query.Expression interface.
+func (o *MinimumShouldMatchOr) Prepare(validator schema.Validator) error {
+	return o.Or.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (o MinimumShouldMatchOr) String() string {
+	return fmt.Sprintf("%s~%d", o.Or, o.MinimumShouldMatch)
+}
+
+// Boosted is a query expression wrapping Expression to multiply its relevance
+// score by Boost. As scores are only computed in query context, boosts have no
+// effect unless ForceQueryContext is set.
+type Boosted struct {
+	Expression query.Expression
+	Boost      float64
+}
+
+// Match implements query.Expression interface.
+func (b Boosted) Match(payload map[string]interface{}) bool {
+	return b.Expression.Match(payload)
+}
+
+// Prepare implements query.Expression interface.
+func (b *Boosted) Prepare(validator schema.Validator) error {
+	return b.Expression.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (b Boosted) String() string {
+	return fmt.Sprintf("%s^%v", b.Expression, b.Boost)
+}
+
+// boost sets the boost of q if supported by its type or wraps it in a
+// function_score query otherwise.
+func boost(q elastic.Query, boost float64) elastic.Query {
+	switch t := q.(type) {
+	case *elastic.TermQuery:
+		return t.Boost(boost)
+	case *elastic.TermsQuery:
+		return t.Boost(boost)
+	case *elastic.RangeQuery:
+		return t.Boost(boost)
+	case *elastic.BoolQuery:
+		return t.Boost(boost)
+	case *elastic.NestedQuery:
+		return t.Boost(boost)
+	case *elastic.RegexpQuery:
+		return t.Boost(boost)
+	default:
+		return elastic.NewFunctionScoreQuery().Query(q).Boost(boost)
+	}
+}
+
+// NamedExpression is a query expression wrapping Expr to name its translated
+// ES query Name. Named queries matching an item are listed by ES in the
+// matched_queries of the hit and appear in the explain output, which helps
+// debugging complex queries.
+type NamedExpression struct {
+	Name string
+	Expr query.Expression
+}
+
+// Match implements query.Expression interface.
+func (n NamedExpression) Match(payload map[string]interface{}) bool {
+	return n.Expr.Match(payload)
+}
+
+// Prepare implements query.Expression interface.
+func (n *NamedExpression) Prepare(validator schema.Validator) error {
+	return n.Expr.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (n NamedExpression) String() string {
+	return fmt.Sprintf("%s#%s", n.Expr, n.Name)
+}
+
+// name sets the name of q if supported by its type or wraps it in a named
+// bool query otherwise.
+func name(q elastic.Query, name string) elastic.Query {
+	switch t := q.(type) {
+	case *elastic.TermQuery:
+		return t.QueryName(name)
+	case *elastic.TermsQuery:
+		return t.QueryName(name)
+	case *elastic.RangeQuery:
+		return t.QueryName(name)
+	case *elastic.BoolQuery:
+		return t.QueryName(name)
+	case *elastic.NestedQuery:
+		return t.QueryName(name)
+	case *elastic.RegexpQuery:
+		return t.QueryName(name)
+	case *elastic.GeoPolygonQuery:
+		return t.QueryName(name)
+	default:
+		return elastic.NewBoolQuery().Must(q).QueryName(name)
+	}
+}
@@ -2,6 +2,7 @@ package es
 
 import (
 	"reflect"
+	"regexp"
 	"testing"
 
 	"github.com/rs/rest-layer/resource"
@@ -33,6 +34,8 @@ func TestGetQuery(t *testing.T) {
 	}{
 		{`{id:"foo"}`, nil,
 			elastic.NewTermQuery("_id", "foo")},
+		{`{_etag:"d41d8cd98f00b204e9800998ecf8427e"}`, nil,
+			elastic.NewTermQuery("_etag", "d41d8cd98f00b204e9800998ecf8427e")},
 		{`{f:"foo"}`, nil,
 			elastic.NewTermQuery("f.keyword", "foo")},
 		{`{f:{$ne:"foo"}}`, nil,
@@ -49,13 +52,25 @@ func TestGetQuery(t *testing.T) {
 			elastic.NewTermsQuery("f.keyword", "foo", "bar")},
 		{`{f:{$nin:["foo","bar"]}}`, nil,
 			elastic.NewBoolQuery().MustNot(elastic.NewTermsQuery("f.keyword", "foo", "bar"))},
-		{`{f:{$regex:"fo[o]{1}.+is.+some"}}`, resource.ErrNotImplemented,
+		{`{f:{$regex:"fo[o]{1}.+is.+some"}}`, nil,
+			elastic.NewRegexpQuery("f.keyword", ".*foo{1,1}.+is.+some.*")},
+		{`{f:{$regex:"^fo+$"}}`, nil,
+			elastic.NewRegexpQuery("f.keyword", "fo+")},
+		{`{f:{$regex:"^[a-c0-9_]*x$"}}`, nil,
+			elastic.NewRegexpQuery("f.keyword", "[0-9_a-c]*x")},
+		{`{f:{$regex:"a\\bb"}}`, resource.ErrNotImplemented,
 			nil},
 		{`{$and:[{f:"foo"},{f:"bar"}]}`, nil,
 			elastic.NewBoolQuery().Must(elastic.NewTermQuery("f.keyword", "foo"), elastic.NewTermQuery("f.keyword", "bar"))},
 		{`{$or:[{f:"foo"},{f:"bar"}]}`, nil,
 			elastic.NewBoolQuery().Should(elastic.NewTermQuery("f.keyword", "foo"), elastic.NewTermQuery("f.keyword", "bar"))},
+		{`{$and:[{f:"foo"},{$and:[{f:"bar"}]}]}`, nil,
+			elastic.NewBoolQuery().Must(elastic.NewTermQuery("f.keyword", "foo"), elastic.NewTermQuery("f.keyword", "bar"))},
+		{`{f:{$in:[]}}`, nil,
+			elastic.NewBoolQuery().MustNot(elastic.NewMatchAllQuery())},
 	}
+	h := &Handler{}
+	hq := &Handler{ForceQueryContext: true}
 	for i := range cases {
 		tc := cases[i]
 		t.Run(tc.predicate, func(t *testing.T) {
@@ -63,40 +78,299 @@ func TestGetQuery(t *testing.T) {
 			if err != nil {
 				t.Error(err)
 			}
-			got, err := getQuery(q)
+			got, err := hq.getQuery(q)
 			if !reflect.DeepEqual(err, tc.err) {
 				t.Errorf("translatePredicate error:\ngot:  %v\nwant: %v", err, tc.err)
 			}
 			if !reflect.DeepEqual(got, tc.want) {
 				t.Errorf("translatePredicate:\ngot:  %#v\nwant: %#v", got, tc.want)
 			}
+			// Queries are wrapped in filter context by default
+			got, err = h.getQuery(q)
+			if !reflect.DeepEqual(err, tc.err) {
+				t.Errorf("translatePredicate error:\ngot:  %v\nwant: %v", err, tc.err)
+			}
+			if want := filterContext(tc.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("translatePredicate:\ngot:  %#v\nwant: %#v", got, want)
+			}
 		})
 	}
 }
 
+// filterContext wraps q in a bool filter query as done by getQuery.
+func filterContext(q elastic.Query) elastic.Query {
+	if q == nil {
+		return nil
+	}
+	return elastic.NewBoolQuery().Filter(q)
+}
+
+func TestGetQueryMultipleRoots(t *testing.T) {
+	q, err := query.New("", `{f:"foo",g:"bar"}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	foo := elastic.NewTermQuery("f.keyword", "foo")
+	bar := elastic.NewTermQuery("g.keyword", "bar")
+	got, err := (&Handler{}).getQuery(q)
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewBoolQuery().Filter(foo, bar), got)
+	got, err = (&Handler{ForceQueryContext: true}).getQuery(q)
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewBoolQuery().Must(foo, bar), got)
+}
+
+func TestGetQueryBoosted(t *testing.T) {
+	h := &Handler{ForceQueryContext: true}
+	got, err := h.getQuery(&query.Query{Predicate: query.Predicate{
+		&Boosted{Expression: &query.Equal{Field: "f", Value: "foo"}, Boost: 2},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewTermQuery("f.keyword", "foo").Boost(2), got)
+	got, err = h.getQuery(&query.Query{Predicate: query.Predicate{
+		&query.Or{
+			&Boosted{Expression: &query.Equal{Field: "f", Value: "foo"}, Boost: 3},
+			&query.Equal{Field: "f", Value: "bar"},
+		},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewBoolQuery().Should(
+		elastic.NewTermQuery("f.keyword", "foo").Boost(3),
+		elastic.NewTermQuery("f.keyword", "bar"),
+	), got)
+	_, err = h.getQuery(&query.Query{Predicate: query.Predicate{
+		&Boosted{Expression: UnsupportedExpression{}, Boost: 2},
+	}})
+	assert.Equal(t, resource.ErrNotImplemented, err)
+}
+
+func TestGetQueryMinimumShouldMatch(t *testing.T) {
+	h := &Handler{ForceQueryContext: true}
+	foo := &query.Equal{Field: "f", Value: "foo"}
+	bar := &query.Equal{Field: "f", Value: "bar"}
+	baz := &query.Equal{Field: "f", Value: "baz"}
+	got, err := h.getQuery(&query.Query{Predicate: query.Predicate{
+		&MinimumShouldMatchOr{Or: query.Or{foo, bar, baz}, MinimumShouldMatch: 2},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewBoolQuery().Should(
+		elastic.NewTermQuery("f.keyword", "foo"),
+		elastic.NewTermQuery("f.keyword", "bar"),
+		elastic.NewTermQuery("f.keyword", "baz"),
+	).MinimumNumberShouldMatch(2), got)
+	// Default is the plain or behavior
+	got, err = h.getQuery(&query.Query{Predicate: query.Predicate{
+		&MinimumShouldMatchOr{Or: query.Or{foo, bar}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewBoolQuery().Should(
+		elastic.NewTermQuery("f.keyword", "foo"),
+		elastic.NewTermQuery("f.keyword", "bar"),
+	), got)
+}
+
+func TestMinimumShouldMatchOrMatch(t *testing.T) {
+	o := MinimumShouldMatchOr{
+		Or: query.Or{
+			&query.Equal{Field: "a", Value: 1},
+			&query.Equal{Field: "b", Value: 1},
+			&query.Equal{Field: "c", Value: 1},
+		},
+		MinimumShouldMatch: 2,
+	}
+	assert.True(t, o.Match(map[string]interface{}{"a": 1, "b": 1}))
+	assert.False(t, o.Match(map[string]interface{}{"a": 1, "b": 2}))
+	o.MinimumShouldMatch = 0
+	assert.True(t, o.Match(map[string]interface{}{"a": 1}))
+}
+
+func TestWrappersPrepare(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"a": {Filterable: true},
+	}}
+	valid := &query.Equal{Field: "a", Value: 1}
+	invalid := &query.Equal{Field: "b", Value: 1}
+	for _, tc := range []struct {
+		valid, invalid query.Expression
+	}{
+		{&MinimumShouldMatchOr{Or: query.Or{valid}, MinimumShouldMatch: 2}, &MinimumShouldMatchOr{Or: query.Or{valid, invalid}, MinimumShouldMatch: 2}},
+		{&Boosted{Expression: valid, Boost: 2}, &Boosted{Expression: invalid, Boost: 2}},
+		{&NamedExpression{Name: "n", Expr: valid}, &NamedExpression{Name: "n", Expr: invalid}},
+	} {
+		assert.NoError(t, tc.valid.Prepare(s), tc.valid.String())
+		assert.EqualError(t, tc.invalid.Prepare(s), "b: unknown query field", tc.invalid.String())
+	}
+}
+
+func TestBoost(t *testing.T) {
+	q := boost(elastic.NewRangeQuery("f").Gt(1), 2)
+	assert.Equal(t, elastic.NewRangeQuery("f").Gt(1).Boost(2), q)
+	q = boost(elastic.NewMatchAllQuery(), 2)
+	assert.Equal(t, elastic.NewFunctionScoreQuery().Query(elastic.NewMatchAllQuery()).Boost(2), q)
+}
+
 func TestTranslatePredicateInvalid(t *testing.T) {
+	h := &Handler{}
 	var err error
-	_, err = translatePredicate(query.Predicate{UnsupportedExpression{}})
+	_, err = h.translatePredicate(query.Predicate{UnsupportedExpression{}})
 	assert.Equal(t, resource.ErrNotImplemented, err)
-	_, err = translatePredicate(query.Predicate{&query.And{UnsupportedExpression{}}})
+	_, err = h.translatePredicate(query.Predicate{&query.And{UnsupportedExpression{}}})
 	assert.Equal(t, resource.ErrNotImplemented, err)
-	_, err = translatePredicate(query.Predicate{&query.Or{UnsupportedExpression{}}})
+	_, err = h.translatePredicate(query.Predicate{&query.Or{UnsupportedExpression{}}})
 	assert.Equal(t, resource.ErrNotImplemented, err)
 }
 
 func TestGetSort(t *testing.T) {
+	h := &Handler{}
 	var s []elastic.Sorter
-	s = getSort(&query.Query{Sort: query.Sort{}})
+	s = h.getSort(&query.Query{Sort: query.Sort{}})
 	assert.Equal(t, []elastic.Sorter(nil), s)
-	s = getSort(&query.Query{Sort: query.Sort{{Name: "id"}}})
-	assert.Equal(t, []elastic.Sorter{elastic.NewFieldSort(getField("id", true)).Asc()}, s)
-	s = getSort(&query.Query{Sort: query.Sort{{Name: "f"}}})
-	assert.Equal(t, []elastic.Sorter{elastic.NewFieldSort(getField("f", true)).Asc()}, s)
-	s = getSort(&query.Query{Sort: query.Sort{{Name: "f", Reversed: true}}})
-	assert.Equal(t, []elastic.Sorter{elastic.NewFieldSort(getField("f", true)).Desc()}, s)
-	s = getSort(&query.Query{Sort: query.Sort{{Name: "f"}, {Name: "f", Reversed: true}}})
+	s = h.getSort(&query.Query{Sort: query.Sort{{Name: "id"}}})
+	assert.Equal(t, []elastic.Sorter{elastic.NewFieldSort(h.getField("id", true)).Asc()}, s)
+	s = h.getSort(&query.Query{Sort: query.Sort{{Name: "f"}}})
+	assert.Equal(t, []elastic.Sorter{elastic.NewFieldSort(h.getField("f", true)).Asc()}, s)
+	s = h.getSort(&query.Query{Sort: query.Sort{{Name: "f", Reversed: true}}})
+	assert.Equal(t, []elastic.Sorter{elastic.NewFieldSort(h.getField("f", true)).Desc()}, s)
+	s = h.getSort(&query.Query{Sort: query.Sort{{Name: "f"}, {Name: "f", Reversed: true}}})
 	assert.Equal(t, []elastic.Sorter{
-		elastic.NewFieldSort(getField("f", true)).Asc(),
-		elastic.NewFieldSort(getField("f", true)).Desc(),
+		elastic.NewFieldSort(h.getField("f", true)).Asc(),
+		elastic.NewFieldSort(h.getField("f", true)).Desc(),
 	}, s)
 }
+
+func TestGetQueryNestedPaths(t *testing.T) {
+	h := &Handler{NestedPaths: []string{"author", "author.books"}}
+	cases := []struct {
+		predicate string
+		want      elastic.Query
+	}{
+		{`{"author.name":"foo"}`,
+			elastic.NewNestedQuery("author", elastic.NewTermQuery("author.name.keyword", "foo"))},
+		{`{"author.books.title":"foo"}`,
+			elastic.NewNestedQuery("author.books", elastic.NewTermQuery("author.books.title.keyword", "foo"))},
+		{`{"author.age":{$gt:1}}`,
+			elastic.NewNestedQuery("author", elastic.NewRangeQuery("author.age").Gt(float64(1)))},
+		{`{"author.name":{$ne:"foo"}}`,
+			elastic.NewBoolQuery().MustNot(elastic.NewNestedQuery("author", elastic.NewTermQuery("author.name.keyword", "foo")))},
+		{`{"authors.name":"foo"}`,
+			elastic.NewTermQuery("authors.name.keyword", "foo")},
+		{`{author:"foo"}`,
+			elastic.NewTermQuery("author.keyword", "foo")},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.predicate, func(t *testing.T) {
+			q, err := query.New("", tc.predicate, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := h.getQuery(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filterContext(tc.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("getQuery:\ngot:  %#v\nwant: %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestGetQueryIntegerFields(t *testing.T) {
+	h := &Handler{ForceQueryContext: true, IntegerFields: []string{"i"}}
+	q, err := query.New("", `{i:{$gte:1},f:{$lt:2}}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	got, err := h.getQuery(q)
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewBoolQuery().Must(
+		elastic.NewRangeQuery("i").Gte(int64(1)),
+		elastic.NewRangeQuery("f").Lt(float64(2)),
+	), got)
+
+	// Fractional bounds match the same integers
+	cases := []struct {
+		query string
+		want  elastic.Query
+	}{
+		{`{i:{$gt:1.5}}`, elastic.NewRangeQuery("i").Gt(int64(1))},
+		{`{i:{$gte:1.5}}`, elastic.NewRangeQuery("i").Gte(int64(2))},
+		{`{i:{$lt:1.5}}`, elastic.NewRangeQuery("i").Lt(int64(2))},
+		{`{i:{$lte:1.5}}`, elastic.NewRangeQuery("i").Lte(int64(1))},
+		{`{i:{$gt:-1.5}}`, elastic.NewRangeQuery("i").Gt(int64(-2))},
+		{`{i:{$lt:-1.5}}`, elastic.NewRangeQuery("i").Lt(int64(-1))},
+		{`{f:{$lt:1.5}}`, elastic.NewRangeQuery("f").Lt(1.5)},
+	}
+	for _, tc := range cases {
+		q, err := query.New("", tc.query, "", nil)
+		if !assert.NoError(t, err, tc.query) {
+			continue
+		}
+		got, err := h.getQuery(q)
+		if assert.NoError(t, err, tc.query) {
+			assert.Equal(t, tc.want, got, tc.query)
+		}
+	}
+}
+
+func TestGetQueryName(t *testing.T) {
+	h := &Handler{ForceQueryContext: true, QueryName: "rl", NestedPaths: []string{"n"}}
+	q, err := query.New("", `{f:"foo",g:{$ne:"bar"},"n.f":{$gt:1}}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	got, err := h.getQuery(q)
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewBoolQuery().Must(
+		elastic.NewTermQuery("f.keyword", "foo").QueryName("rl"),
+		elastic.NewBoolQuery().MustNot(elastic.NewTermQuery("g.keyword", "bar").QueryName("rl")),
+		elastic.NewNestedQuery("n", elastic.NewRangeQuery("n.f").Gt(float64(1)).QueryName("rl")),
+	), got)
+}
+
+func TestGetQueryNamedExpression(t *testing.T) {
+	h := &Handler{ForceQueryContext: true, QueryName: "rl"}
+	foo := &query.Equal{Field: "f", Value: "foo"}
+	bar := &query.Equal{Field: "f", Value: "bar"}
+	got, err := h.getQuery(&query.Query{Predicate: query.Predicate{
+		&NamedExpression{Name: "either", Expr: &query.Or{&NamedExpression{Name: "foo", Expr: foo}, bar}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewBoolQuery().Should(
+		elastic.NewTermQuery("f.keyword", "foo").QueryName("foo"),
+		elastic.NewTermQuery("f.keyword", "bar").QueryName("rl"),
+	).QueryName("either"), got)
+	_, err = h.getQuery(&query.Query{Predicate: query.Predicate{
+		&NamedExpression{Name: "foo", Expr: UnsupportedExpression{}},
+	}})
+	assert.Equal(t, resource.ErrNotImplemented, err)
+}
+
+func TestName(t *testing.T) {
+	q := name(elastic.NewMatchAllQuery(), "all")
+	assert.Equal(t, elastic.NewBoolQuery().Must(elastic.NewMatchAllQuery()).QueryName("all"), q)
+}
+
+func TestGetSortDefaults(t *testing.T) {
+	h := &Handler{SortDefaults: map[string]bool{"updated": true, "f": false}}
+	s := h.getSort(&query.Query{Sort: query.Sort{{Name: "updated"}, {Name: "f"}, {Name: "g"}}})
+	assert.Equal(t, []elastic.Sorter{
+		elastic.NewFieldSort(h.getField("updated", true)).Desc(),
+		elastic.NewFieldSort(h.getField("f", true)).Asc(),
+		elastic.NewFieldSort(h.getField("g", true)).Asc(),
+	}, s)
+	s = h.getSort(&query.Query{Sort: query.Sort{{Name: "updated", Reversed: true}, {Name: "f", Reversed: true}}})
+	assert.Equal(t, []elastic.Sorter{
+		elastic.NewFieldSort(h.getField("updated", true)).Asc(),
+		elastic.NewFieldSort(h.getField("f", true)).Desc(),
+	}, s)
+}
+
+func TestGetQueryRegexNegated(t *testing.T) {
+	h := &Handler{ForceQueryContext: true}
+	got, err := h.getQuery(&query.Query{Predicate: query.Predicate{
+		&query.Regex{Field: "f", Value: regexp.MustCompile("^foo"), Negated: true},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, elastic.NewBoolQuery().MustNot(elastic.NewRegexpQuery("f.keyword", "foo.*")), got)
+}
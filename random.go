@@ -0,0 +1,37 @@
+package es
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// FindWithRandomScore finds items matching q like Find, but orders them
+// randomly. The order is stable for a given seed, so different seeds can be
+// used to show different orderings to different users (i.e.: A/B testing)
+// while keeping pagination consistent. The sort of q is ignored.
+func (h *Handler) FindWithRandomScore(ctx context.Context, q *query.Query, seed int64) (*resource.ItemList, error) {
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	q = h.filterQuery(ctx, q)
+	qry, err := h.getQuery(q)
+	if err != nil {
+		return nil, fmt.Errorf("find query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+	}
+	// Replace the query score by the random score so the ordering does not
+	// depend on the query relevance.
+	fsq := elastic.NewFunctionScoreQuery().
+		AddScoreFunc(elastic.NewRandomFunction().Seed(seed)).
+		BoostMode("replace")
+	if qry != nil {
+		fsq.Query(qry)
+	}
+	// Keep the projection and the predicate (used for routing and type
+	// selection) of q, only the sort is dropped.
+	rq := *q
+	rq.Sort = nil
+	return h.find(ctx, &rq, fsq)
+}
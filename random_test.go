@@ -0,0 +1,101 @@
+package es
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestFindWithRandomScore(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindrandom")()
+	h := NewHandler(c, "testfindrandom", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{}
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"} {
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "name": id}})
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	ids := func(l *resource.ItemList) []interface{} {
+		ids := []interface{}{}
+		for _, i := range l.Items {
+			ids = append(ids, i.ID)
+		}
+		return ids
+	}
+
+	q, err := query.New("", "", "", query.Page(1, 10, 0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	l1, err := h.FindWithRandomScore(ctx, q, 42)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 10, l1.Total)
+	l2, err := h.FindWithRandomScore(ctx, q, 42)
+	if assert.NoError(t, err) {
+		// Same seed, same order
+		assert.Equal(t, ids(l1), ids(l2))
+	}
+
+	q, err = query.New("", `{name:{$in:["3","7"]}}`, "", query.Page(1, 10, 0))
+	if assert.NoError(t, err) {
+		l, err := h.FindWithRandomScore(ctx, q, 42)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 2, l.Total)
+		}
+	}
+}
+
+func TestFindWithRandomScoreProjectionRouting(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindrandomrouting")()
+	h := NewHandler(c, "testfindrandomrouting", "test", WithShards(4))
+	h.Refresh = "true"
+	h.ParentIDField = "post_id"
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	items := []*resource.Item{
+		{ID: "c1", Payload: map[string]interface{}{"id": "c1", "post_id": "p1", "name": "a"}},
+		{ID: "c2", Payload: map[string]interface{}{"id": "c2", "post_id": "p1", "name": "b"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+	// Documents of p1 stored on other shards than the p1 one are not found by
+	// searches routed by the query predicate
+	for _, r := range []string{"a", "b", "x"} {
+		_, err := c.Index().Index("testfindrandomrouting").Type("test").Id("m" + r).Routing(r).Refresh("true").
+			BodyJson(map[string]interface{}{"post_id": "p1", "name": r}).Do(ctx)
+		assert.NoError(t, err)
+	}
+
+	q, err := query.New("post_id", `{post_id:"p1"}`, "name", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := h.FindWithRandomScore(ctx, q, 42)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 2) {
+		assert.Equal(t, 2, l.Total)
+		for _, i := range l.Items {
+			assert.Equal(t, map[string]interface{}{"id": i.ID, "post_id": "p1"}, i.Payload)
+		}
+	}
+}
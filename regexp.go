@@ -0,0 +1,190 @@
+package es
+
+import (
+	"bytes"
+	"errors"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// errUnsupportedRegexp is returned by luceneRegexp for RE2 constructs without
+// Lucene regular expression equivalent.
+var errUnsupportedRegexp = errors.New("unsupported regular expression")
+
+// luceneReserved lists the characters with a special meaning in Lucene
+// regular expressions, including the optional operators enabled by default.
+const luceneReserved = `.?+*|{}[]()"\#@&<>~`
+
+// luceneRegexp translates the RE2 pattern into the Lucene regular expression
+// syntax used by ES regexp queries.
+//
+// Lucene regular expressions always match the whole term, so unanchored
+// patterns are wrapped with .* while the ^ and $ anchors are removed. Anchors
+// anywhere else, word boundaries and flags without equivalent are not
+// supported.
+func luceneRegexp(pattern string) (string, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	prefix, suffix := ".*", ".*"
+	if len(subs) > 0 && isBeginAnchor(subs[0]) {
+		prefix = ""
+		subs = subs[1:]
+	}
+	if len(subs) > 0 && isEndAnchor(subs[len(subs)-1]) {
+		suffix = ""
+		subs = subs[:len(subs)-1]
+	}
+	b := &bytes.Buffer{}
+	b.WriteString(prefix)
+	for _, sub := range subs {
+		if err := writeLuceneRegexp(b, sub); err != nil {
+			return "", err
+		}
+	}
+	b.WriteString(suffix)
+	return b.String(), nil
+}
+
+func isBeginAnchor(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpBeginText || re.Op == syntax.OpBeginLine
+}
+
+func isEndAnchor(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpEndText || re.Op == syntax.OpEndLine
+}
+
+// writeLuceneRegexp writes the Lucene syntax of re to b.
+func writeLuceneRegexp(b *bytes.Buffer, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		b.WriteString("()")
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && unicode.ToLower(r) != unicode.ToUpper(r) {
+				b.WriteByte('[')
+				writeLuceneRune(b, unicode.ToLower(r), "")
+				writeLuceneRune(b, unicode.ToUpper(r), "")
+				b.WriteByte(']')
+				continue
+			}
+			writeLuceneRune(b, r, luceneReserved)
+		}
+	case syntax.OpCharClass:
+		writeLuceneCharClass(b, re.Rune)
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		b.WriteByte('.')
+	case syntax.OpCapture:
+		if re.Sub[0].Op == syntax.OpAlternate {
+			// Alternations are already grouped
+			return writeLuceneRegexp(b, re.Sub[0])
+		}
+		b.WriteByte('(')
+		if err := writeLuceneRegexp(b, re.Sub[0]); err != nil {
+			return err
+		}
+		b.WriteByte(')')
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		// Greediness makes no difference when matching whole terms
+		if err := writeLuceneAtom(b, re.Sub[0]); err != nil {
+			return err
+		}
+		switch re.Op {
+		case syntax.OpStar:
+			b.WriteByte('*')
+		case syntax.OpPlus:
+			b.WriteByte('+')
+		case syntax.OpQuest:
+			b.WriteByte('?')
+		default:
+			b.WriteString("{" + strconv.Itoa(re.Min) + ",")
+			if re.Max >= 0 {
+				b.WriteString(strconv.Itoa(re.Max))
+			}
+			b.WriteByte('}')
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if err := writeLuceneRegexp(b, sub); err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		b.WriteByte('(')
+		for i, sub := range re.Sub {
+			if i > 0 {
+				b.WriteByte('|')
+			}
+			if err := writeLuceneRegexp(b, sub); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(')')
+	default:
+		// Anchors not at the pattern ends, word boundaries and no match
+		return errUnsupportedRegexp
+	}
+	return nil
+}
+
+// writeLuceneAtom writes re to b, grouping it if it's made of several atoms
+// so a following quantifier applies to the whole of it.
+func writeLuceneAtom(b *bytes.Buffer, re *syntax.Regexp) error {
+	single := re.Op == syntax.OpCharClass || re.Op == syntax.OpAnyChar || re.Op == syntax.OpAnyCharNotNL ||
+		re.Op == syntax.OpCapture || re.Op == syntax.OpAlternate ||
+		(re.Op == syntax.OpLiteral && len(re.Rune) == 1 && re.Flags&syntax.FoldCase == 0)
+	if single {
+		return writeLuceneRegexp(b, re)
+	}
+	b.WriteByte('(')
+	if err := writeLuceneRegexp(b, re); err != nil {
+		return err
+	}
+	b.WriteByte(')')
+	return nil
+}
+
+// writeLuceneCharClass writes the character class made of the ranges of
+// ranges to b, as a negated class when shorter.
+func writeLuceneCharClass(b *bytes.Buffer, ranges []rune) {
+	negated := len(ranges) > 0 && ranges[0] == 0 && ranges[len(ranges)-1] == unicode.MaxRune
+	if negated {
+		// Turn the ranges into the ranges of the complement
+		complement := []rune{}
+		for i := 1; i+1 < len(ranges); i += 2 {
+			complement = append(complement, ranges[i]+1, ranges[i+1]-1)
+		}
+		if len(complement) == 0 {
+			// Any character
+			b.WriteByte('.')
+			return
+		}
+		ranges = complement
+		b.WriteString("[^")
+	} else {
+		b.WriteByte('[')
+	}
+	for i := 0; i+1 < len(ranges); i += 2 {
+		writeLuceneRune(b, ranges[i], `[]^-\"`)
+		if ranges[i+1] != ranges[i] {
+			b.WriteByte('-')
+			writeLuceneRune(b, ranges[i+1], `[]^-\"`)
+		}
+	}
+	b.WriteByte(']')
+}
+
+// writeLuceneRune writes r to b, escaping it if it is part of reserved.
+func writeLuceneRune(b *bytes.Buffer, r rune, reserved string) {
+	if strings.ContainsRune(reserved, r) {
+		b.WriteByte('\\')
+	}
+	b.WriteRune(r)
+}
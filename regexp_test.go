@@ -0,0 +1,52 @@
+package es
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLuceneRegexp(t *testing.T) {
+	cases := []struct {
+		pattern string
+		want    string
+		err     bool
+	}{
+		{`foo`, `.*foo.*`, false},
+		{`^foo`, `foo.*`, false},
+		{`foo$`, `.*foo`, false},
+		{`^foo$`, `foo`, false},
+		{`\Afoo\z`, `foo`, false},
+		{`^$`, ``, false},
+		{`^a.b$`, `a.b`, false},
+		{`^[a-z]+$`, `[a-z]+`, false},
+		{`^[^a-z]$`, `[^a-z]`, false},
+		{`^\d{2,4}$`, `[0-9]{2,4}`, false},
+		{`^a{3,}$`, `a{3,}`, false},
+		{`^(ab)*c?$`, `(ab)*c?`, false},
+		{`^(?:ab)+$`, `(ab)+`, false},
+		{`^a|b$`, ``, true},
+		{`^(a|bc)$`, `(a|bc)`, false},
+		{`^a+?$`, `a+`, false},
+		{`^a\.b\+c$`, `a\.b\+c`, false},
+		{`^"#@&<>~$`, `\"\#\@\&\<\>\~`, false},
+		{`^(?i)ab$`, `[aA][bB]`, false},
+		{`^[\]\-]$`, `[\-\]]`, false},
+		{`^(?s:.)$`, `.`, false},
+		{`a\bb`, ``, true},
+		{`a^b`, ``, true},
+		{`(`, ``, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			got, err := luceneRegexp(tc.pattern)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, got)
+			}
+		})
+	}
+}
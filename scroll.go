@@ -0,0 +1,87 @@
+package es
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// scrollPageSize is the number of documents fetched per scroll request.
+const scrollPageSize = 500
+
+// Scroll calls fn with every item matching q, paging through the result set
+// with an ES scroll cursor instead of from/size pagination, which is limited by
+// the index.max_result_window setting (10000 by default). It is meant for
+// export or batch jobs. The window of q is ignored, all matching items are
+// passed to fn. Without sort, documents are returned in index order, which is
+// the most efficient.
+//
+// The scrollTTL (i.e.: "1m") is the time ES keeps the cursor alive between two
+// pages. It must thus be longer than the time it takes to process a page of
+// items. The cursor is cleared once the iteration ends, when ctx is canceled or
+// when fn returns an error, in which case this error is returned.
+func (h *Handler) Scroll(ctx context.Context, q *query.Query, scrollTTL string, fn func(*resource.Item) error) error {
+	q = h.filterQuery(ctx, q)
+	qry, err := h.getQuery(q)
+	if err != nil {
+		return fmt.Errorf("scroll query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+	}
+	s := h.reader().Scroll(h.index).Type(h.searchTypes(q)...).Scroll(scrollTTL).Size(scrollPageSize)
+	if qry != nil {
+		s.Query(qry)
+	}
+	if srt := h.getSort(q); len(srt) > 0 {
+		s.SortBy(srt...)
+	} else {
+		s.SortBy(elastic.SortByDoc{})
+	}
+	if r := h.searchRouting(ctx, q); r != "" {
+		s.Routing(r)
+	}
+	if p := h.preference(ctx); p != "" {
+		s.Preference(p)
+	}
+	if h.SourceDisabled {
+		s.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(etagField, updatedField))
+	} else if fsc := h.projectedSource(q.Projection); fsc != nil {
+		s.FetchSourceContext(fsc)
+	}
+
+	scrollID := ""
+	defer func() {
+		if scrollID != "" {
+			// ctx may be canceled, the cursor is cleared regardless. On
+			// failure, ES releases it anyway once scrollTTL expires.
+			h.reader().ClearScroll(scrollID).Do(context.Background())
+		}
+	}()
+	for {
+		res, err := s.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if !translateError(&err) {
+				err = fmt.Errorf("scroll error (index=%s, type=%s): %v", h.index, h.typ, err)
+			}
+			return err
+		}
+		scrollID = res.ScrollId
+		if res.Hits == nil || len(res.Hits.Hits) == 0 {
+			return nil
+		}
+		items, err := buildHitItems(res.Hits.Hits)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package es
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestScroll(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testscroll")()
+	h := NewHandler(c, "testscroll", "test")
+	h.Refresh = "true"
+	// More items than a scroll page
+	items := []*resource.Item{}
+	for i := 0; i < 2*scrollPageSize+100; i++ {
+		id := strconv.Itoa(i)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i, "even": i%2 == 0}})
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{"even":true}`, "n", query.Page(1, 10, 0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	ns := []int{}
+	err = h.Scroll(ctx, q, "1m", func(item *resource.Item) error {
+		ns = append(ns, int(item.Payload["n"].(float64)))
+		return nil
+	})
+	if assert.NoError(t, err) && assert.Len(t, ns, scrollPageSize+50) {
+		// The window is ignored and the sort applied
+		for i, n := range ns {
+			assert.Equal(t, 2*i, n)
+		}
+	}
+
+	// Errors returned by fn stop the iteration
+	errStop := errors.New("stop")
+	count := 0
+	err = h.Scroll(ctx, &query.Query{}, "1m", func(item *resource.Item) error {
+		count++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, count)
+}
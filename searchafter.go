@@ -0,0 +1,61 @@
+package es
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// FindAfter finds items matching q like Find, but paginates using the ES
+// search_after cursor instead of from/size, which becomes expensive for deep
+// pages as ES has to skip all the documents before the offset.
+//
+// A nil cursor returns the first page. The returned cursor holds the sort
+// values of the last item of the page and must be passed to the next call to
+// get the following page. It is nil when the page is empty. The offset of the
+// q window is ignored, its limit being the page size.
+//
+// A sort is required and should end with a unique field (i.e.: a creation
+// date followed by the id) so items sharing the same sort values are neither
+// skipped nor repeated across pages.
+func (h *Handler) FindAfter(ctx context.Context, q *query.Query, cursor []interface{}) (*resource.ItemList, []interface{}, error) {
+	if len(q.Sort) == 0 {
+		return nil, nil, errors.New("find after requires a sort")
+	}
+	ctx, cancel := h.withTimeout(ctx)
+	defer cancel()
+	q = h.filterQuery(ctx, q)
+	qry, err := h.getQuery(q)
+	if err != nil {
+		return nil, nil, fmt.Errorf("find query translation error (index=%s, type=%s): %v", h.index, h.typ, err)
+	}
+	// search_after cannot be combined with an offset
+	if q.Window != nil && q.Window.Offset > 0 {
+		nq := *q
+		nq.Window = &query.Window{Limit: q.Window.Limit}
+		q = &nq
+	}
+	s, err := h.newSearch(ctx, q, qry)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cursor) > 0 {
+		s.SearchAfter(cursor...)
+	}
+	res, err := h.search(ctx, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := buildItemList(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	var next []interface{}
+	if res.Hits != nil && len(res.Hits.Hits) > 0 {
+		next = res.Hits.Hits[len(res.Hits.Hits)-1].Sort
+	}
+	return list, next, nil
+}
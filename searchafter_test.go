@@ -0,0 +1,61 @@
+package es
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestFindAfterRequiresSort(t *testing.T) {
+	h := NewHandler(nil, "index", "type")
+	_, _, err := h.FindAfter(context.Background(), &query.Query{}, nil)
+	assert.EqualError(t, err, "find after requires a sort")
+}
+
+func TestFindAfter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindafter")()
+	h := NewHandler(c, "testfindafter", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{}
+	for i := 0; i < 5; i++ {
+		id := strconv.Itoa(i)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i}})
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	// The offset is ignored
+	q, err := query.New("", "", "-n", query.Page(2, 2, 0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	ids := []interface{}{}
+	var cursor []interface{}
+	for page := 0; page < 4; page++ {
+		l, next, err := h.FindAfter(ctx, q, cursor)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 5, l.Total)
+		for _, i := range l.Items {
+			ids = append(ids, i.ID)
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []interface{}{"4", "3", "2", "1", "0"}, ids)
+}
@@ -0,0 +1,213 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// ShardInfo holds the statistics of a single shard of the handler's index.
+type ShardInfo struct {
+	// DocCount is the number of documents stored in the shard.
+	DocCount int
+	// StoreSize is the size of the shard on disk in bytes.
+	StoreSize int64
+	// SegmentCount is the number of Lucene segments composing the shard.
+	SegmentCount int
+}
+
+// shardStats is the subset of the ES indices stats response (with
+// level=shards) used to build ShardInfo.
+type shardStats struct {
+	Indices map[string]struct {
+		Shards map[string][]struct {
+			Routing struct {
+				Primary bool `json:"primary"`
+			} `json:"routing"`
+			Docs struct {
+				Count int `json:"count"`
+			} `json:"docs"`
+			Store struct {
+				SizeInBytes int64 `json:"size_in_bytes"`
+			} `json:"store"`
+			Segments struct {
+				Count int `json:"count"`
+			} `json:"segments"`
+		} `json:"shards"`
+	} `json:"indices"`
+}
+
+// ShardStats returns the statistics of each shard of the handler's index keyed
+// by shard number. Only primary shards are reported, replicas holding the same
+// data. If the index does not exist, resource.ErrNotFound is returned.
+//
+// The indices stats service of the elastic client does not expose shard level
+// statistics, so the stats API is queried directly.
+func (h *Handler) ShardStats(ctx context.Context) (map[int]*ShardInfo, error) {
+	params := url.Values{}
+	params.Set("level", "shards")
+	path := fmt.Sprintf("/%s/_stats/docs,store,segments", url.PathEscape(h.index))
+	res, err := h.client.PerformRequest(ctx, "GET", path, params, nil)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("shard stats error (index=%s): %v", h.index, err)
+		}
+		return nil, err
+	}
+	stats := shardStats{}
+	if err := json.Unmarshal(res.Body, &stats); err != nil {
+		return nil, fmt.Errorf("shard stats unmarshaling error (index=%s): %v", h.index, err)
+	}
+	shards := map[int]*ShardInfo{}
+	// If the handler's index is an alias, the stats of all the indices it
+	// points to are summed per shard number.
+	for _, index := range stats.Indices {
+		for num, copies := range index.Shards {
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return nil, fmt.Errorf("shard stats invalid shard number (index=%s): %q", h.index, num)
+			}
+			for _, c := range copies {
+				if !c.Routing.Primary {
+					continue
+				}
+				s := shards[n]
+				if s == nil {
+					s = &ShardInfo{}
+					shards[n] = s
+				}
+				s.DocCount += c.Docs.Count
+				s.StoreSize += c.Store.SizeInBytes
+				s.SegmentCount += c.Segments.Count
+			}
+		}
+	}
+	return shards, nil
+}
+
+// SegmentCount returns the total number of Lucene segments of the primary
+// shards of the handler's index. A high segment count slows down searches and
+// is a sign the index would benefit from a force merge.
+func (h *Handler) SegmentCount(ctx context.Context) (int, error) {
+	shards, err := h.ShardStats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, s := range shards {
+		count += s.SegmentCount
+	}
+	return count, nil
+}
+
+// defaultSegmentCheckInterval is the minimum duration between two segment
+// count checks when SegmentCheckInterval is not set.
+const defaultSegmentCheckInterval = time.Minute
+
+// checkSegments calls OnTooManySegments if the segment count of the index
+// exceeds MaxSegments. The count is retrieved in the background, so searches
+// are not slowed down, and at most once per SegmentCheckInterval.
+func (h *Handler) checkSegments() {
+	if h.MaxSegments <= 0 || h.OnTooManySegments == nil {
+		return
+	}
+	interval := h.SegmentCheckInterval
+	if interval <= 0 {
+		interval = defaultSegmentCheckInterval
+	}
+	now := time.Now()
+	h.segmentsMu.Lock()
+	if now.Sub(h.segmentsCheckedAt) < interval {
+		h.segmentsMu.Unlock()
+		return
+	}
+	h.segmentsCheckedAt = now
+	h.segmentsMu.Unlock()
+	go func() {
+		ctx, cancel := h.withTimeout(context.Background())
+		defer cancel()
+		if count, err := h.SegmentCount(ctx); err == nil && count > h.MaxSegments {
+			h.OnTooManySegments(count)
+		}
+	}()
+}
+
+const (
+	// nodeHeapThreshold is the JVM heap usage above which a node is
+	// considered overloaded.
+	nodeHeapThreshold = 85
+	// nodeCPUThreshold is the CPU usage above which a node is considered
+	// overloaded.
+	nodeCPUThreshold = 90
+)
+
+// NodeInfo holds the resource usage statistics of a cluster node.
+type NodeInfo struct {
+	// ID is the id of the node.
+	ID string
+	// Name is the name of the node.
+	Name string
+	// Host is the host name of the node.
+	Host string
+	// HeapUsedPercent is the percentage of the JVM heap in use.
+	HeapUsedPercent float64
+	// CPUPercent is the recent CPU usage of the whole system of the node.
+	CPUPercent float64
+	// DiskFreeBytes is the free disk space of the node data paths in bytes.
+	DiskFreeBytes int64
+}
+
+// Overloaded returns true if the heap usage of the node exceeds 85% or its
+// CPU usage exceeds 90%.
+func (n NodeInfo) Overloaded() bool {
+	return n.HeapUsedPercent > nodeHeapThreshold || n.CPUPercent > nodeCPUThreshold
+}
+
+// NodeStats returns the resource usage statistics of each node of the cluster,
+// sorted by node name, so overloaded nodes can be detected (see
+// NodeInfo.Overloaded), for instance from a health check endpoint.
+// OnOverloaded, if set, is called with each overloaded node.
+func (h *Handler) NodeStats(ctx context.Context) ([]NodeInfo, error) {
+	res, err := h.client.NodesStats().Metric("os", "jvm", "fs").Do(ctx)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("node stats error: %v", err)
+		}
+		return nil, err
+	}
+	nodes := buildNodeInfos(res)
+	if h.OnOverloaded != nil {
+		for _, n := range nodes {
+			if n.Overloaded() {
+				h.OnOverloaded(n)
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// buildNodeInfos returns the NodeInfo of each node of a nodes stats response.
+func buildNodeInfos(res *elastic.NodesStatsResponse) []NodeInfo {
+	nodes := make([]NodeInfo, 0, len(res.Nodes))
+	for id, n := range res.Nodes {
+		ni := NodeInfo{ID: id, Name: n.Name, Host: n.Host}
+		if n.JVM != nil && n.JVM.Mem != nil {
+			ni.HeapUsedPercent = float64(n.JVM.Mem.HeapUsedPercent)
+		}
+		if n.OS != nil && n.OS.CPU != nil {
+			ni.CPUPercent = float64(n.OS.CPU.Percent)
+		}
+		if n.FS != nil && n.FS.Total != nil {
+			ni.DiskFreeBytes = n.FS.Total.FreeInBytes
+		}
+		nodes = append(nodes, ni)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
@@ -0,0 +1,170 @@
+package es
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestShardStats(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testshardstats")()
+	h := NewHandler(c, "testshardstats", "test")
+	h.Refresh = "true"
+	ctx := context.TODO()
+
+	// Stats must not auto-create the index
+	_, err = h.ShardStats(ctx)
+	assert.Equal(t, resource.ErrNotFound, err)
+
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "c"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	stats, err := h.ShardStats(ctx)
+	if assert.NoError(t, err) && assert.NotEmpty(t, stats) {
+		docs := 0
+		for _, s := range stats {
+			docs += s.DocCount
+			assert.True(t, s.StoreSize > 0)
+		}
+		assert.Equal(t, 3, docs)
+	}
+
+	segments, err := h.SegmentCount(ctx)
+	if assert.NoError(t, err) {
+		assert.True(t, segments > 0)
+	}
+}
+
+func TestCheckSegments(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testchecksegments")()
+	h := NewHandler(c, "testchecksegments", "test", WithShards(1))
+	h.Refresh = "true"
+	ctx := context.TODO()
+	assert.NoError(t, h.EnsureIndex(ctx))
+	// Each refreshed insert creates a new segment
+	for _, id := range []string{"1", "2", "3"} {
+		assert.NoError(t, h.Insert(ctx, []*resource.Item{{ID: id, Payload: map[string]interface{}{"id": id}}}))
+	}
+
+	counts := make(chan int, 2)
+	h.MaxSegments = 1
+	h.OnTooManySegments = func(count int) {
+		counts <- count
+	}
+	q := &query.Query{}
+	_, err = h.Find(ctx, q)
+	assert.NoError(t, err)
+	select {
+	case count := <-counts:
+		assert.True(t, count > 1)
+	case <-time.After(5 * time.Second):
+		t.Error("OnTooManySegments not called")
+	}
+
+	// Checks are rate limited
+	_, err = h.Find(ctx, q)
+	assert.NoError(t, err)
+	select {
+	case <-counts:
+		t.Error("OnTooManySegments called twice")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestCheckSegmentsDisabled(t *testing.T) {
+	called := false
+	h := &Handler{OnTooManySegments: func(int) { called = true }}
+	// Without MaxSegments, no check is performed (the handler has no client)
+	h.checkSegments()
+	assert.False(t, called)
+	assert.True(t, h.segmentsCheckedAt.IsZero())
+}
+
+func TestBuildNodeInfos(t *testing.T) {
+	res := &elastic.NodesStatsResponse{Nodes: map[string]*elastic.NodesStatsNode{
+		"id2": {
+			Name: "b",
+			Host: "10.0.0.2",
+			JVM:  &elastic.NodesStatsNodeJVM{Mem: &elastic.NodesStatsNodeJVMMem{HeapUsedPercent: 90}},
+			OS:   &elastic.NodesStatsNodeOS{CPU: &elastic.NodesStatsNodeOSCPU{Percent: 10}},
+			FS:   &elastic.NodesStatsNodeFS{Total: &elastic.NodesStatsNodeFSEntry{FreeInBytes: 1024}},
+		},
+		"id1": {Name: "a", Host: "10.0.0.1"},
+	}}
+	nodes := buildNodeInfos(res)
+	assert.Equal(t, []NodeInfo{
+		{ID: "id1", Name: "a", Host: "10.0.0.1"},
+		{ID: "id2", Name: "b", Host: "10.0.0.2", HeapUsedPercent: 90, CPUPercent: 10, DiskFreeBytes: 1024},
+	}, nodes)
+	assert.False(t, nodes[0].Overloaded())
+	assert.True(t, nodes[1].Overloaded())
+	assert.True(t, NodeInfo{CPUPercent: 95}.Overloaded())
+}
+
+func TestNodeStats(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(c, "testnodestats", "test")
+	nodes, err := h.NodeStats(context.TODO())
+	if assert.NoError(t, err) && assert.NotEmpty(t, nodes) {
+		assert.NotEmpty(t, nodes[0].ID)
+		assert.NotEmpty(t, nodes[0].Name)
+		assert.True(t, nodes[0].DiskFreeBytes > 0)
+	}
+}
+
+func TestNodeStatsOnOverloaded(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"cluster_name":"test","nodes":{
+			"id1":{"name":"a","host":"10.0.0.1","jvm":{"mem":{"heap_used_percent":50}},"os":{"cpu":{"percent":10}}},
+			"id2":{"name":"b","host":"10.0.0.2","jvm":{"mem":{"heap_used_percent":90}},"os":{"cpu":{"percent":10}}},
+			"id3":{"name":"c","host":"10.0.0.3","jvm":{"mem":{"heap_used_percent":50}},"os":{"cpu":{"percent":95}}}
+		}}`))
+	}))
+	defer ts.Close()
+	c, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(c, "index", "type")
+	overloaded := []string{}
+	h.OnOverloaded = func(n NodeInfo) {
+		overloaded = append(overloaded, n.Name)
+	}
+	nodes, err := h.NodeStats(context.Background())
+	if assert.NoError(t, err) {
+		assert.Len(t, nodes, 3)
+	}
+	assert.Equal(t, []string{"b", "c"}, overloaded)
+}
@@ -0,0 +1,65 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// suggestResult is the subset of the ES search response used by
+// SuggestWithContext.
+type suggestResult struct {
+	Suggest map[string][]struct {
+		Options []struct {
+			Text string `json:"text"`
+		} `json:"options"`
+	} `json:"suggest"`
+}
+
+// SuggestWithContext returns up to size completions of prefix from the
+// completion suggester field, filtered by contexts. The contexts map holds the
+// accepted values of each context by context name: category values for
+// category contexts and geohashes for geo contexts. The completion field must
+// be mapped with the corresponding contexts configuration (see SuggestFields to
+// feed it).
+//
+// The completion suggester of the elastic client only supports category
+// contexts with ES 5, so the suggest request is sent directly.
+func (h *Handler) SuggestWithContext(ctx context.Context, field, prefix string, contexts map[string][]string, size int) ([]string, error) {
+	completion := map[string]interface{}{
+		"field": field,
+		"size":  size,
+	}
+	if len(contexts) > 0 {
+		completion["contexts"] = contexts
+	}
+	body := map[string]interface{}{
+		"size": 0,
+		"suggest": map[string]interface{}{
+			field: map[string]interface{}{
+				"prefix":     prefix,
+				"completion": completion,
+			},
+		},
+	}
+	path := fmt.Sprintf("/%s/_search", url.PathEscape(h.index))
+	res, err := h.reader().PerformRequest(ctx, "POST", path, nil, body)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("suggest error (index=%s, field=%s): %v", h.index, field, err)
+		}
+		return nil, err
+	}
+	sr := suggestResult{}
+	if err := json.Unmarshal(res.Body, &sr); err != nil {
+		return nil, fmt.Errorf("suggest unmarshaling error (index=%s, field=%s): %v", h.index, field, err)
+	}
+	suggestions := []string{}
+	for _, s := range sr.Suggest[field] {
+		for _, o := range s.Options {
+			suggestions = append(suggestions, o.Text)
+		}
+	}
+	return suggestions, nil
+}
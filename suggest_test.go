@@ -0,0 +1,46 @@
+package es
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestSuggestWithContext(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testsuggestcontext")()
+	ctx := context.TODO()
+	_, err = c.CreateIndex("testsuggestcontext").BodyString(`{"mappings":{"test":{"properties":{
+		"name_suggest":{"type":"completion","contexts":[{"name":"kind","type":"category","path":"kind"}]}
+	}}}}`).Do(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(c, "testsuggestcontext", "test")
+	h.Refresh = "true"
+	h.SuggestFields = map[string]string{"name": "name_suggest"}
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "apple", "kind": "fruit"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "apricot", "kind": "fruit"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "aperol", "kind": "drink"}},
+	}
+	assert.NoError(t, h.Insert(ctx, items))
+
+	s, err := h.SuggestWithContext(ctx, "name_suggest", "ap", map[string][]string{"kind": {"fruit"}}, 10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"apple", "apricot"}, s)
+	}
+	s, err = h.SuggestWithContext(ctx, "name_suggest", "ap", map[string][]string{"kind": {"drink"}}, 10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"aperol"}, s)
+	}
+}
@@ -0,0 +1,259 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// templateParam returns the placeholder used in place of the i-th value of a
+// query when it is turned into a search template.
+func templateParam(i int) string {
+	return fmt.Sprintf("__rest_layer_param_%d__", i)
+}
+
+// templatize returns a copy of p with all its values replaced by placeholders,
+// and the list of the replaced values in placeholder order. Two queries with
+// the same structure but different values thus have the same templatized
+// predicate. Range values are converted as by translatePredicate so templated
+// searches match the same items.
+func (h *Handler) templatize(p query.Predicate) (query.Predicate, []interface{}, error) {
+	params := []interface{}{}
+	param := func(v query.Value) query.Value {
+		params = append(params, v)
+		return templateParam(len(params) - 1)
+	}
+	var tpl func(e query.Expression) (query.Expression, error)
+	tpl = func(e query.Expression) (query.Expression, error) {
+		switch t := e.(type) {
+		case *query.And:
+			and := make(query.And, len(*t))
+			for i, subExp := range *t {
+				se, err := tpl(subExp)
+				if err != nil {
+					return nil, err
+				}
+				and[i] = se
+			}
+			return &and, nil
+		case *query.Or:
+			or := make(query.Or, len(*t))
+			for i, subExp := range *t {
+				se, err := tpl(subExp)
+				if err != nil {
+					return nil, err
+				}
+				or[i] = se
+			}
+			return &or, nil
+		case *query.In:
+			values := make([]query.Value, len(t.Values))
+			for i, v := range t.Values {
+				values[i] = param(v)
+			}
+			return &query.In{Field: t.Field, Values: values}, nil
+		case *query.NotIn:
+			values := make([]query.Value, len(t.Values))
+			for i, v := range t.Values {
+				values[i] = param(v)
+			}
+			return &query.NotIn{Field: t.Field, Values: values}, nil
+		case *query.Equal:
+			return &query.Equal{Field: t.Field, Value: param(t.Value)}, nil
+		case *query.NotEqual:
+			return &query.NotEqual{Field: t.Field, Value: param(t.Value)}, nil
+		case *query.GreaterThan:
+			return &query.GreaterThan{Field: t.Field, Value: param(h.rangeValue(t.Field, t.Value, math.Floor))}, nil
+		case *query.GreaterOrEqual:
+			return &query.GreaterOrEqual{Field: t.Field, Value: param(h.rangeValue(t.Field, t.Value, math.Ceil))}, nil
+		case *query.LowerThan:
+			return &query.LowerThan{Field: t.Field, Value: param(h.rangeValue(t.Field, t.Value, math.Ceil))}, nil
+		case *query.LowerOrEqual:
+			return &query.LowerOrEqual{Field: t.Field, Value: param(h.rangeValue(t.Field, t.Value, math.Floor))}, nil
+		default:
+			return nil, resource.ErrNotImplemented
+		}
+	}
+	tp := make(query.Predicate, len(p))
+	for i, e := range p {
+		te, err := tpl(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		tp[i] = te
+	}
+	return tp, params, nil
+}
+
+// templatizeQuery returns the key identifying the structure of q regardless of
+// its values, with the templatized predicate and the values extracted from q.
+func (h *Handler) templatizeQuery(q *query.Query) (string, query.Predicate, []interface{}, error) {
+	tp, params, err := h.templatize(q.Predicate)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	sort := make([]string, len(q.Sort))
+	for i, s := range q.Sort {
+		if s.Reversed {
+			sort[i] = "-" + s.Name
+		} else {
+			sort[i] = s.Name
+		}
+	}
+	return tp.String() + "|" + strings.Join(sort, ","), tp, params, nil
+}
+
+// PrecompileQuery stores the ES translation of q as a search template named
+// name. Once precompiled, Find executes queries having the same structure as q
+// (same fields, operators and sort but potentially different values) using the
+// stored template, only sending the query values and the search timeout derived
+// from the context to ES. Searches needing options templates do not hold
+// (routing, field collapsing, shard timeout or projection) are performed
+// without template. The template is stored in the
+// read cluster when a read client is set.
+func (h *Handler) PrecompileQuery(ctx context.Context, name string, q *query.Query) error {
+	key, tp, params, err := h.templatizeQuery(q)
+	if err != nil {
+		return fmt.Errorf("precompile query translation error (name=%s): %v", name, err)
+	}
+	src := map[string]interface{}{
+		"from": "__rest_layer_from__",
+		"size": "__rest_layer_size__",
+	}
+	qry, err := h.getQuery(&query.Query{Predicate: tp})
+	if err != nil {
+		return fmt.Errorf("precompile query translation error (name=%s): %v", name, err)
+	}
+	if qry != nil {
+		if src["query"], err = qry.Source(); err != nil {
+			return fmt.Errorf("precompile query source error (name=%s): %v", name, err)
+		}
+	}
+	// The source filter is a parameter so the source settings of the
+	// handler at search time apply
+	src["_source"] = "__rest_layer_source__"
+	if srt := h.getSort(q); len(srt) > 0 {
+		sort := make([]interface{}, len(srt))
+		for i, s := range srt {
+			if sort[i], err = s.Source(); err != nil {
+				return fmt.Errorf("precompile sort source error (name=%s): %v", name, err)
+			}
+		}
+		src["sort"] = sort
+	}
+	b, err := json.Marshal(src)
+	if err != nil {
+		return fmt.Errorf("precompile query marshaling error (name=%s): %v", name, err)
+	}
+	// Replace placeholders (including their quotes) by mustache variables so
+	// values are rendered with their JSON type.
+	tpl := string(b)
+	tpl = strings.Replace(tpl, `"__rest_layer_from__"`, "{{from}}", 1)
+	tpl = strings.Replace(tpl, `"__rest_layer_size__"`, "{{size}}", 1)
+	tpl = strings.Replace(tpl, `"__rest_layer_source__"`, "{{#toJson}}source{{/toJson}}", 1)
+	// The search timeout is a parameter only rendered when set
+	tpl = tpl[:len(tpl)-1] + `{{#timeout}},"timeout":"{{timeout}}"{{/timeout}}}`
+	for i := range params {
+		tpl = strings.Replace(tpl, `"`+templateParam(i)+`"`, fmt.Sprintf("{{#toJson}}p%d{{/toJson}}", i), -1)
+	}
+	path := fmt.Sprintf("/_search/template/%s", url.PathEscape(name))
+	if _, err = h.reader().PerformRequest(ctx, "PUT", path, nil, map[string]interface{}{"template": tpl}); err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("precompile query error (name=%s): %v", name, err)
+		}
+		return err
+	}
+	h.templatesMu.Lock()
+	if h.templates == nil {
+		h.templates = map[string]string{}
+	}
+	h.templates[key] = name
+	h.templatesMu.Unlock()
+	return nil
+}
+
+// templateSource returns the value of the _source parameter of precompiled
+// templates, built from the current source settings of the handler.
+func (h *Handler) templateSource() (interface{}, error) {
+	if h.SourceDisabled {
+		return []string{etagField, updatedField}, nil
+	}
+	if fsc := h.fetchSource(); fsc != nil {
+		return fsc.Source()
+	}
+	return true, nil
+}
+
+// getTemplate returns the name of the precompiled template matching the
+// structure of q with the template parameters or an empty name if no template
+// matches.
+func (h *Handler) getTemplate(q *query.Query) (string, map[string]interface{}) {
+	h.templatesMu.RLock()
+	defer h.templatesMu.RUnlock()
+	if len(h.templates) == 0 {
+		return "", nil
+	}
+	key, _, values, err := h.templatizeQuery(q)
+	if err != nil {
+		return "", nil
+	}
+	name, found := h.templates[key]
+	if !found {
+		return "", nil
+	}
+	source, err := h.templateSource()
+	if err != nil {
+		return "", nil
+	}
+	params := map[string]interface{}{"from": 0, "size": 10, "source": source}
+	for i, v := range values {
+		params[fmt.Sprintf("p%d", i)] = v
+	}
+	if q.Window != nil {
+		if q.Window.Offset > 0 {
+			params["from"] = q.Window.Offset
+		}
+		if q.Window.Limit >= 0 {
+			params["size"] = q.Window.Limit
+		}
+	}
+	return name, params
+}
+
+// findTemplate executes the name search template with params on the types
+// and returns the result as a resource.ItemList. The search timeout is derived
+// from ctx as for other searches.
+func (h *Handler) findTemplate(ctx context.Context, name string, params map[string]interface{}, types []string) (*resource.ItemList, error) {
+	if t := h.timeout(ctx); t != "" {
+		params["timeout"] = t
+	}
+	escaped := make([]string, len(types))
+	for i, typ := range types {
+		escaped[i] = url.PathEscape(typ)
+	}
+	path := fmt.Sprintf("/%s/%s/_search/template", url.PathEscape(h.index), strings.Join(escaped, ","))
+	body := map[string]interface{}{"id": name, "params": params}
+	var query url.Values
+	if p := h.preference(ctx); p != "" {
+		query = url.Values{"preference": []string{p}}
+	}
+	res, err := h.reader().PerformRequest(ctx, "POST", path, query, body)
+	if err != nil {
+		if !translateError(&err) {
+			err = fmt.Errorf("find template error (index=%s, type=%s, template=%s): %v", h.index, h.typ, name, err)
+		}
+		return nil, err
+	}
+	sr := &elastic.SearchResult{}
+	if err := json.Unmarshal(res.Body, sr); err != nil {
+		return nil, fmt.Errorf("find template unmarshaling error (index=%s, type=%s, template=%s): %v", h.index, h.typ, name, err)
+	}
+	return buildItemList(sr)
+}
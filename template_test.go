@@ -0,0 +1,164 @@
+package es
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func TestTemplatizeQuery(t *testing.T) {
+	q1, err := query.New("", `{name:"a",age:{$gt:1},tags:{$in:["x","y"]}}`, "-name", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	q2, err := query.New("", `{name:"b",age:{$gt:2},tags:{$in:["z","w"]}}`, "-name", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	q3, err := query.New("", `{name:"b",age:{$gt:2},tags:{$in:["z","w"]}}`, "name", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := &Handler{}
+	k1, _, p1, err := h.templatizeQuery(q1)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", float64(1), "x", "y"}, p1)
+	k2, _, p2, err := h.templatizeQuery(q2)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"b", float64(2), "z", "w"}, p2)
+	k3, _, _, err := h.templatizeQuery(q3)
+	assert.NoError(t, err)
+	assert.Equal(t, k1, k2)
+	assert.NotEqual(t, k1, k3)
+
+	_, _, _, err = h.templatizeQuery(&query.Query{Predicate: query.Predicate{UnsupportedExpression{}}})
+	assert.Equal(t, resource.ErrNotImplemented, err)
+
+	// Range values of integer fields are rounded as for untemplated searches
+	h.IntegerFields = []string{"age"}
+	q4, err := query.New("", `{$and:[{age:{$gt:1.5}},{age:{$lt:3.5}}],tags:{$in:[1.5]}}`, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, p4, err := h.templatizeQuery(q4)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []interface{}{int64(1), int64(4), float64(1.5)}, p4)
+}
+
+func TestFindPrecompiled(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindprecompiled")()
+	h := NewHandler(c, "testfindprecompiled", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a", "age": 1}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b", "age": 2}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "c", "age": 3}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{name:{$in:["a","b"]},age:{$gte:0}}`, "name", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, h.PrecompileQuery(ctx, "testfindprecompiled", q))
+
+	q, err = query.New("", `{name:{$in:["b","c"]},age:{$gte:3}}`, "name", query.Page(1, 10, 0))
+	if assert.NoError(t, err) {
+		l, err := h.Find(ctx, q)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 1, l.Total)
+			if assert.Len(t, l.Items, 1) {
+				assert.Equal(t, "3", l.Items[0].ID)
+			}
+		}
+	}
+}
+
+func TestFindPrecompiledSameResults(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	c, err := elastic.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(c, "testfindprecompiledsame")()
+	h := NewHandler(c, "testfindprecompiledsame", "test")
+	h.Refresh = "true"
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a", "age": 1, "secret": "s"}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "name": "b", "age": 1, "secret": "s"}},
+		{ID: "3", ETag: "c", Payload: map[string]interface{}{"id": "3", "name": "c", "age": 3, "secret": "s"}},
+	}
+	ctx := context.TODO()
+	assert.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{age:{$gte:0}}`, "name", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, h.PrecompileQuery(ctx, "testfindprecompiledsame", q))
+	q, err = query.New("", `{age:{$lt:0}}`, "name", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, h.PrecompileQuery(ctx, "testfindprecompiledsamelt", q))
+
+	// plain shares the index of h but has no precompiled template
+	plain := NewHandler(c, "testfindprecompiledsame", "test")
+	cases := []struct {
+		name   string
+		setup  func(h *Handler)
+		proj   string
+		filter string
+	}{
+		{"default", func(h *Handler) {}, "", ""},
+		{"source excludes", func(h *Handler) { h.SourceExcludes = []string{"secret"} }, "", ""},
+		{"source disabled", func(h *Handler) { h.SourceDisabled = true }, "", ""},
+		{"collapse", func(h *Handler) { h.CollapseField = "age" }, "", ""},
+		{"routing", func(h *Handler) { h.DefaultRouting = "r" }, "", ""},
+		{"projection", func(h *Handler) {}, "name", ""},
+		{"integer fields", func(h *Handler) { h.IntegerFields = []string{"age"} }, "", `{age:{$lt:1.5}}`},
+	}
+	for _, tc := range cases {
+		for _, h := range []*Handler{h, plain} {
+			h.SourceExcludes, h.SourceDisabled, h.CollapseField, h.DefaultRouting = nil, false, "", ""
+			h.IntegerFields = nil
+		}
+		tc.setup(h)
+		tc.setup(plain)
+		filter := tc.filter
+		if filter == "" {
+			filter = `{age:{$gte:1}}`
+		}
+		q, err := query.New(tc.proj, filter, "name", query.Page(1, 10, 0))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		// The search timeout derived from the context is sent with templates
+		tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		want, err := plain.Find(tctx, q)
+		if !assert.NoError(t, err, tc.name) {
+			cancel()
+			continue
+		}
+		got, err := h.Find(tctx, q)
+		cancel()
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, want, got, tc.name)
+		}
+	}
+}
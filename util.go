@@ -11,12 +11,15 @@ import (
 )
 
 const (
-	etagField    = "_etag"
-	updatedField = "_updated"
+	etagField      = "_etag"
+	updatedField   = "_updated"
+	innerHitsField = "_inner_hits"
 )
 
-// buildDoc builds an ElasticSearch document from a resource.Item
-func buildDoc(i *resource.Item) map[string]interface{} {
+// buildDoc builds an ElasticSearch document from a resource.Item. For each
+// field of suggestFields present in the item, the completion suggester input
+// is added to the document under the mapped suggester field.
+func buildDoc(i *resource.Item, suggestFields map[string]string) map[string]interface{} {
 	// Filter out id from the payload so we don't store it twice
 	d := map[string]interface{}{}
 	for k, v := range i.Payload {
@@ -24,6 +27,17 @@ func buildDoc(i *resource.Item) map[string]interface{} {
 			d[k] = v
 		}
 	}
+	for f, sf := range suggestFields {
+		v, found := i.Payload[f]
+		if !found || v == nil {
+			continue
+		}
+		input, ok := v.([]interface{})
+		if !ok {
+			input = []interface{}{v}
+		}
+		d[sf] = map[string]interface{}{"input": input}
+	}
 	if i.ETag != "" {
 		d[etagField] = i.ETag
 	}
@@ -42,8 +56,14 @@ func buildItem(id string, d map[string]interface{}) *resource.Item {
 	if etag, ok := d[etagField].(string); ok {
 		i.ETag = etag
 	}
-	if updated, ok := d[updatedField].(time.Time); ok {
+	switch updated := d[updatedField].(type) {
+	case time.Time:
 		i.Updated = updated
+	case string:
+		// Documents decoded from JSON hold the date as a string
+		if t, err := time.Parse(time.RFC3339Nano, updated); err == nil {
+			i.Updated = t
+		}
 	}
 	for k, v := range d {
 		if k != etagField && k != updatedField {
@@ -74,6 +94,9 @@ func translateError(err *error) bool {
 	} else if elastic.IsNotFound(*err) {
 		*err = resource.ErrNotFound
 		return true
+	} else if isTooManyRequests(*err) {
+		*err = ErrTooManyRequests
+		return true
 	}
 	return false
 }
@@ -90,6 +113,75 @@ func ctxTimeout(ctx context.Context) string {
 	return ""
 }
 
+// timeout returns the ES timeout argument for an operation, which is the
+// handler's ShardTimeout if set or the context deadline otherwise.
+func (h *Handler) timeout(ctx context.Context) string {
+	if h.ShardTimeout > 0 {
+		return fmt.Sprintf("%dms", int(h.ShardTimeout/time.Millisecond))
+	}
+	return ctxTimeout(ctx)
+}
+
+// withTimeout returns a context with the handler's ShardTimeout as deadline if
+// set and ctx has no deadline.
+func (h *Handler) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); !ok && h.ShardTimeout > 0 {
+		return context.WithTimeout(ctx, h.ShardTimeout)
+	}
+	return ctx, func() {}
+}
+
+// fetchSource returns the source filter built from the handler's
+// SourceIncludes and SourceExcludes or nil if the whole source is returned. The
+// ETag and Updated fields are always included while the SuggestFields
+// suggester fields are always excluded.
+func (h *Handler) fetchSource() *elastic.FetchSourceContext {
+	excludes := append([]string{}, h.SourceExcludes...)
+	for _, sf := range h.SuggestFields {
+		excludes = append(excludes, sf)
+	}
+	if len(h.SourceIncludes) == 0 && len(excludes) == 0 {
+		return nil
+	}
+	fsc := elastic.NewFetchSourceContext(true)
+	if len(h.SourceIncludes) > 0 {
+		fsc.Include(append([]string{etagField, updatedField}, h.SourceIncludes...)...)
+	}
+	if len(excludes) > 0 {
+		fsc.Exclude(excludes...)
+	}
+	return fsc
+}
+
+// projectedSource returns the source filter for a query projecting p. When p
+// lists fields, only those are fetched on top of the ETag and Updated fields.
+// The id field, stored as the document _id, is never part of the source. If p
+// is empty, uses the "*" wildcard or SourceIncludes is set, the handler's
+// source filter is returned, REST Layer applying the projection on the
+// returned items anyway.
+func (h *Handler) projectedSource(p query.Projection) *elastic.FetchSourceContext {
+	if len(p) == 0 || len(h.SourceIncludes) > 0 {
+		return h.fetchSource()
+	}
+	includes := []string{etagField, updatedField}
+	for _, pf := range p {
+		switch pf.Name {
+		case "*":
+			return h.fetchSource()
+		case "id":
+			continue
+		}
+		// Sub-field projections (children) are applied by REST Layer, the
+		// whole field is fetched.
+		includes = append(includes, pf.Name)
+	}
+	fsc := h.fetchSource()
+	if fsc == nil {
+		fsc = elastic.NewFetchSourceContext(true)
+	}
+	return fsc.Include(includes...)
+}
+
 func valuesToInterface(v []query.Value) []interface{} {
 	I := make([]interface{}, len(v))
 	for i, _v := range v {
@@ -8,18 +8,26 @@ import (
 	"time"
 
 	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/olivere/elastic.v5"
 )
 
 func TestBuildDoc(t *testing.T) {
-	assert.Equal(t, map[string]interface{}{}, buildDoc(&resource.Item{}))
+	assert.Equal(t, map[string]interface{}{}, buildDoc(&resource.Item{}, nil))
 	assert.Equal(t, map[string]interface{}{"foo": "bar"},
-		buildDoc(&resource.Item{Payload: map[string]interface{}{"foo": "bar"}}))
+		buildDoc(&resource.Item{Payload: map[string]interface{}{"foo": "bar"}}, nil))
 	assert.Equal(t, map[string]interface{}{"foo": "bar", "_etag": "123"},
-		buildDoc(&resource.Item{Payload: map[string]interface{}{"id": "1", "foo": "bar"}, ETag: "123"}))
+		buildDoc(&resource.Item{Payload: map[string]interface{}{"id": "1", "foo": "bar"}, ETag: "123"}, nil))
 	assert.Equal(t, map[string]interface{}{"foo": "bar", "_updated": now},
-		buildDoc(&resource.Item{Payload: map[string]interface{}{"id": "1", "foo": "bar"}, Updated: now}))
+		buildDoc(&resource.Item{Payload: map[string]interface{}{"id": "1", "foo": "bar"}, Updated: now}, nil))
+	suggest := map[string]string{"name": "name_suggest", "tags": "tags_suggest", "other": "other_suggest"}
+	assert.Equal(t, map[string]interface{}{
+		"name":         "Alice",
+		"name_suggest": map[string]interface{}{"input": []interface{}{"Alice"}},
+		"tags":         []interface{}{"a", "b"},
+		"tags_suggest": map[string]interface{}{"input": []interface{}{"a", "b"}},
+	}, buildDoc(&resource.Item{Payload: map[string]interface{}{"name": "Alice", "tags": []interface{}{"a", "b"}}}, suggest))
 }
 
 func TestBuildItem(t *testing.T) {
@@ -31,6 +39,42 @@ func TestBuildItem(t *testing.T) {
 		buildItem("1", map[string]interface{}{"foo": "bar", "_etag": "123"}))
 	assert.Equal(t, &resource.Item{ID: "1", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "bar"}},
 		buildItem("1", map[string]interface{}{"foo": "bar", "_updated": now}))
+	i := buildItem("1", map[string]interface{}{"foo": "bar", "_updated": now.Format(time.RFC3339Nano)})
+	assert.True(t, now.Equal(i.Updated))
+	assert.Equal(t, map[string]interface{}{"id": "1", "foo": "bar"}, i.Payload)
+}
+
+func TestProjectedSource(t *testing.T) {
+	h := NewHandler(nil, "index", "type")
+	assert.Nil(t, h.projectedSource(nil))
+	assert.Nil(t, h.projectedSource(query.Projection{{Name: "*"}, {Name: "name"}}))
+
+	src, err := h.projectedSource(query.Projection{
+		{Name: "id"},
+		{Name: "name"},
+		{Name: "meta", Children: query.Projection{{Name: "title"}}},
+	}).Source()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"includes": []string{etagField, updatedField, "name", "meta"},
+	}, src)
+
+	h.SourceExcludes = []string{"secret"}
+	src, err = h.projectedSource(query.Projection{{Name: "name"}}).Source()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"includes": []string{etagField, updatedField, "name"},
+		"excludes": []string{"secret"},
+	}, src)
+
+	// The handler's includes take precedence
+	h.SourceExcludes = nil
+	h.SourceIncludes = []string{"title"}
+	src, err = h.projectedSource(query.Projection{{Name: "name"}}).Source()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"includes": []string{etagField, updatedField, "title"},
+	}, src)
 }
 
 func TestTranslateError(t *testing.T) {
@@ -51,6 +95,10 @@ func TestTranslateError(t *testing.T) {
 	err = &elastic.Error{Status: http.StatusNotFound}
 	assert.True(t, translateError(&err))
 	assert.Equal(t, resource.ErrNotFound, err)
+
+	err = &elastic.Error{Status: http.StatusTooManyRequests}
+	assert.True(t, translateError(&err))
+	assert.Equal(t, ErrTooManyRequests, err)
 }
 
 func TestCtxTimeout(t *testing.T) {
@@ -63,3 +111,29 @@ func TestCtxTimeout(t *testing.T) {
 	ctx, _ = context.WithTimeout(context.Background(), -1*time.Second)
 	assert.Equal(t, "0ms", ctxTimeout(ctx))
 }
+
+func TestHandlerTimeout(t *testing.T) {
+	h := &Handler{}
+	ctx := context.Background()
+	assert.Equal(t, "", h.timeout(ctx))
+	wctx, cancel := h.withTimeout(ctx)
+	_, ok := wctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+
+	dctx, dcancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer dcancel()
+	assert.Equal(t, "9ms", h.timeout(dctx))
+
+	h.ShardTimeout = 2 * time.Second
+	assert.Equal(t, "2000ms", h.timeout(ctx))
+	assert.Equal(t, "2000ms", h.timeout(dctx))
+	wctx, cancel = h.withTimeout(ctx)
+	_, ok = wctx.Deadline()
+	assert.True(t, ok)
+	cancel()
+	// An existing context deadline is kept as the request deadline
+	wctx, cancel = h.withTimeout(dctx)
+	assert.Equal(t, dctx, wctx)
+	cancel()
+}